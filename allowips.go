@@ -0,0 +1,352 @@
+package caddy_webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// ipRangesRefresh is how often IP ranges are fetched from their
+	// sources.
+	ipRangesRefresh = 24 * time.Hour
+
+	// ipRangesTimeout is the timeout to fetch IP ranges.
+	ipRangesTimeout = 30 * time.Second
+)
+
+// ipRangeSources are the built-in sources of the IP ranges git
+// services send webhooks from.
+var ipRangeSources = map[string]struct {
+	url   string
+	parse func([]byte) ([]string, error)
+}{
+	"github": {
+		url:   "https://api.github.com/meta",
+		parse: parseGithubMeta,
+	},
+	"atlassian": {
+		url:   "https://ip-ranges.atlassian.com/",
+		parse: parseAtlassianIPRanges,
+	},
+}
+
+// AllowList verifies webhook requests come from allowed IP ranges.
+type AllowList struct {
+	// CacheDir is the directory to cache the IP ranges fetched from
+	// sources in, which are used until they are fetched again after
+	// a restart. Not cached if empty.
+	CacheDir string
+
+	nets    []*net.IPNet
+	sources []*ipRangeSource
+	proxies []*net.IPNet
+}
+
+// ipRangeSource holds the IP ranges fetched from a source.
+type ipRangeSource struct {
+	name  string
+	url   string
+	parse func([]byte) ([]string, error)
+	cache string
+
+	mu   sync.RWMutex
+	nets []*net.IPNet
+}
+
+// NewAllowList creates the allow list of IPs, CIDRs and names of
+// IP range sources, which trusts the X-Forwarded-For header of
+// requests from trusted proxies.
+func NewAllowList(allowIPs, trustedProxies []string) (*AllowList, error) {
+	a := new(AllowList)
+
+	for _, ip := range allowIPs {
+		if source, ok := ipRangeSources[ip]; ok {
+			a.sources = append(a.sources, &ipRangeSource{
+				name:  ip,
+				url:   source.url,
+				parse: source.parse,
+			})
+			continue
+		}
+
+		ipNet, err := parseIPNet(ip)
+		if err != nil {
+			return nil, fmt.Errorf("allow_ips: %v", err)
+		}
+		a.nets = append(a.nets, ipNet)
+	}
+
+	for _, ip := range trustedProxies {
+		ipNet, err := parseIPNet(ip)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_proxies: %v", err)
+		}
+		a.proxies = append(a.proxies, ipNet)
+	}
+
+	return a, nil
+}
+
+// SetSourceURL sets the URL to fetch the IP ranges of the source
+// name from.
+func (a *AllowList) SetSourceURL(name, url string) error {
+	if _, ok := ipRangeSources[name]; !ok {
+		return fmt.Errorf("unknown IP ranges source %q", name)
+	}
+
+	for _, source := range a.sources {
+		if source.name == name {
+			source.url = url
+		}
+	}
+	return nil
+}
+
+// Start loads the cached IP ranges of the sources, and fetches them
+// in background and refreshes them until ctx is done.
+func (a *AllowList) Start(ctx context.Context, log *zap.Logger) {
+	for _, source := range a.sources {
+		if a.CacheDir != "" {
+			source.cache = filepath.Join(a.CacheDir, source.name+".json")
+			if err := source.load(); err != nil && !os.IsNotExist(err) {
+				log.Warn("cannot load cached IP ranges",
+					zap.Error(err),
+					zap.String("source", source.name))
+			}
+		}
+
+		go source.run(ctx, log)
+	}
+}
+
+// Verify returns an error if the client of r is not allowed.
+func (a *AllowList) Verify(r *http.Request) error {
+	ip := a.clientIP(r)
+	if ip == nil {
+		return fmt.Errorf("invalid client IP %q", r.RemoteAddr)
+	}
+
+	if containsIP(a.nets, ip) {
+		return nil
+	}
+	for _, source := range a.sources {
+		source.mu.RLock()
+		ok := containsIP(source.nets, ip)
+		source.mu.RUnlock()
+
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("IP %s is not allowed", ip)
+}
+
+// clientIP returns the IP of the client of r. Requests from trusted
+// proxies are from the last untrusted IP in X-Forwarded-For.
+func (a *AllowList) clientIP(r *http.Request) net.IP {
+	ip := net.ParseIP(hostOnly(r.RemoteAddr))
+	if ip == nil || !containsIP(a.proxies, ip) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip = net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil || !containsIP(a.proxies, ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+func (s *ipRangeSource) run(ctx context.Context, log *zap.Logger) {
+	for {
+		if err := s.refresh(ctx); err != nil {
+			log.Error("cannot fetch IP ranges",
+				zap.Error(err),
+				zap.String("source", s.name))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ipRangesRefresh):
+		}
+	}
+}
+
+// refresh fetches the IP ranges of the source.
+func (s *ipRangeSource) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, ipRangesTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: HTTP %d", s.url, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	err = s.update(body)
+	if err != nil {
+		return err
+	}
+
+	if s.cache != "" {
+		return writeFileAtomic(s.cache, body)
+	}
+	return nil
+}
+
+// load loads the cached IP ranges of the source.
+func (s *ipRangeSource) load() error {
+	body, err := ioutil.ReadFile(s.cache)
+	if err != nil {
+		return err
+	}
+	return s.update(body)
+}
+
+// update parses the IP ranges of the source from body.
+func (s *ipRangeSource) update(body []byte) error {
+	cidrs, err := s.parse(body)
+	if err != nil {
+		return err
+	}
+
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		ipNet, err := parseIPNet(cidr)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, ipNet)
+	}
+	if len(nets) == 0 {
+		return fmt.Errorf("no IP ranges from %s", s.name)
+	}
+
+	s.mu.Lock()
+	s.nets = nets
+	s.mu.Unlock()
+	return nil
+}
+
+// parseGithubMeta parses the IP ranges of GitHub webhooks from the
+// response of its meta API.
+func parseGithubMeta(body []byte) ([]string, error) {
+	var meta struct {
+		Hooks []string `json:"hooks"`
+	}
+
+	err := json.Unmarshal(body, &meta)
+	return meta.Hooks, err
+}
+
+// parseAtlassianIPRanges parses the IP ranges of Atlassian, which
+// include those of Bitbucket webhooks.
+func parseAtlassianIPRanges(body []byte) ([]string, error) {
+	var ranges struct {
+		Items []struct {
+			CIDR string `json:"cidr"`
+		} `json:"items"`
+	}
+
+	err := json.Unmarshal(body, &ranges)
+	if err != nil {
+		return nil, err
+	}
+
+	var cidrs []string
+	for _, item := range ranges.Items {
+		cidrs = append(cidrs, item.CIDR)
+	}
+	return cidrs, nil
+}
+
+// parseIPNet parses a CIDR, or an IP as a single address network.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		return ipNet, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP %q", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// writeFileAtomic writes data to the file at path through a temporary
+// file, so the file is never partially written.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func hostOnly(remoteAddr string) string {
+	host, _, _ := net.SplitHostPort(remoteAddr)
+	if host == "" {
+		return remoteAddr
+	}
+	return host
+}
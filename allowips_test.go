@@ -0,0 +1,148 @@
+package caddy_webhook
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"go.uber.org/zap"
+)
+
+func TestAllowList(t *testing.T) {
+	a, err := NewAllowList(
+		[]string{"18.246.31.128/25", "2600:1f18:2146:e300::/56", "192.0.2.1"},
+		[]string{"10.0.0.0/8"},
+	)
+	assert.Nil(t, err)
+
+	for i, test := range []struct {
+		remoteAddr string
+		forwarded  []string
+		ok         bool
+	}{
+		{"18.246.31.130:443", nil, true},
+		{"[2600:1f18:2146:e306:939f:d1b3:aa36:ac42]:443", nil, true},
+		{"192.0.2.1:443", nil, true},
+		{"192.0.2.2:443", nil, false},
+		{"131.103.20.160:443", nil, false},
+		{"invalid", nil, false},
+
+		// X-Forwarded-For is only trusted from proxies.
+		{"131.103.20.160:443", []string{"18.246.31.130"}, false},
+		{"10.0.0.1:443", []string{"18.246.31.130"}, true},
+		{"10.0.0.1:443", []string{"131.103.20.160"}, false},
+		{"10.0.0.1:443", []string{"18.246.31.130, 10.0.0.2"}, true},
+		{"10.0.0.1:443", []string{"18.246.31.130", "10.0.0.2"}, true},
+		{"10.0.0.1:443", []string{"131.103.20.160, 18.246.31.130"}, true},
+		{"10.0.0.1:443", []string{"18.246.31.130, 131.103.20.160"}, false},
+		{"10.0.0.1:443", nil, false},
+	} {
+		req, err := http.NewRequest("POST", "/webhook", nil)
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.RemoteAddr = test.remoteAddr
+		for _, forwarded := range test.forwarded {
+			req.Header.Add("X-Forwarded-For", forwarded)
+		}
+
+		err = a.Verify(req)
+		assert.Equal(t, test.ok, err == nil, fmt.Sprintf("case %d", i))
+	}
+
+	_, err = NewAllowList([]string{"not an ip"}, nil)
+	assert.NotNil(t, err)
+	_, err = NewAllowList(nil, []string{"10.0.0.0/33"})
+	assert.NotNil(t, err)
+}
+
+func TestIPRangeSources(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/meta":
+			_, _ = w.Write([]byte(`{"hooks": ["192.30.252.0/22", "2a0a:a440::/29"], "web": ["20.201.28.151/32"]}`))
+		case "/atlassian":
+			_, _ = w.Write([]byte(`{"items": [{"network": "18.246.31.128", "mask_len": 25, "cidr": "18.246.31.128/25"}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	a, err := NewAllowList([]string{"github", "atlassian"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(a.sources))
+
+	verify := func(ip string) error {
+		req, err := http.NewRequest("POST", "/webhook", nil)
+		assert.Nil(t, err)
+		req.RemoteAddr = ip + ":443"
+		return a.Verify(req)
+	}
+
+	// Requests are rejected until the ranges are fetched.
+	assert.NotNil(t, verify("192.30.252.1"))
+
+	assert.Nil(t, a.SetSourceURL("github", server.URL+"/meta"))
+	assert.Nil(t, a.SetSourceURL("atlassian", server.URL+"/atlassian"))
+	assert.NotNil(t, a.SetSourceURL("gitlab", server.URL))
+	for _, source := range a.sources {
+		assert.Nil(t, source.refresh(context.Background()))
+	}
+
+	assert.Nil(t, verify("192.30.252.1"))
+	assert.Nil(t, verify("2a0a:a440::1"))
+	assert.Nil(t, verify("18.246.31.130"))
+	assert.NotNil(t, verify("20.201.28.151"))
+
+	// The ranges are kept if they cannot be refreshed.
+	a.sources[0].url = server.URL + "/not_found"
+	assert.NotNil(t, a.sources[0].refresh(context.Background()))
+	assert.Nil(t, verify("192.30.252.1"))
+}
+
+func TestIPRangesCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook-ip-ranges")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"hooks": ["192.30.252.0/22"]}`))
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, err := NewAllowList([]string{"github"}, nil)
+	assert.Nil(t, err)
+	a.CacheDir = dir
+	assert.Nil(t, a.SetSourceURL("github", server.URL))
+	a.Start(ctx, zap.NewNop())
+
+	// Wait for the ranges to be fetched and cached.
+	cache := filepath.Join(dir, "github.json")
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(cache); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.Close()
+
+	// The cached ranges are used while the source is unavailable.
+	a, err = NewAllowList([]string{"github"}, nil)
+	assert.Nil(t, err)
+	a.CacheDir = dir
+	assert.Nil(t, a.SetSourceURL("github", server.URL))
+	a.Start(ctx, zap.NewNop())
+
+	req, err := http.NewRequest("POST", "/webhook", nil)
+	assert.Nil(t, err)
+	req.RemoteAddr = "192.30.252.1:443"
+	assert.Nil(t, a.Verify(req))
+}
@@ -0,0 +1,78 @@
+package caddy_webhook
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+const (
+	// BackendGoGit manages the repository with go-git.
+	BackendGoGit = "go-git"
+
+	// BackendGitCLI manages the repository with the git command.
+	BackendGitCLI = "git-cli"
+)
+
+// Backend manages the local git repository.
+type Backend interface {
+	// RemoteRefs lists the references of the remote repository.
+	RemoteRefs(ctx context.Context) ([]*plumbing.Reference, error)
+
+	// Setup clones the repository with ref checked out, or opens it
+	// and checks out ref if it exists.
+	Setup(ctx context.Context, ref plumbing.ReferenceName) error
+
+	// Fetch fetches the branches and tags of the remote repository.
+	Fetch(ctx context.Context) error
+
+	// Checkout resets the worktree to commit, or to ref as fetched from
+	// the remote if commit is zero. A checked out branch is moved
+	// to the commit.
+	Checkout(ctx context.Context, ref plumbing.ReferenceName, commit plumbing.Hash) error
+
+	// Pull fetches the branch ref and merges it into the worktree.
+	Pull(ctx context.Context, ref plumbing.ReferenceName) error
+
+	// Head returns the checked out commit.
+	Head(ctx context.Context) (plumbing.Hash, error)
+
+	// Follows reports whether commit descends from head. In shallow
+	// repositories, where the history between them may be missing,
+	// their commit times are compared instead.
+	Follows(ctx context.Context, commit, head plumbing.Hash) (bool, error)
+
+	// Preview fetches ref, such as the head of a pull request, into
+	// the repository, which is created if missing, and checks it out
+	// detached.
+	Preview(ctx context.Context, ref plumbing.ReferenceName) error
+}
+
+// newBackend creates the backend of the repository at path, which is
+// the path of the repository or of one of its previews.
+func newBackend(r *Repo, path string) (Backend, error) {
+	switch r.Backend {
+	case "", BackendGoGit:
+		return &goGit{
+			url:       r.URL,
+			path:      path,
+			depth:     r.Depth,
+			sparse:    r.Sparse,
+			submodule: r.Submodule,
+			auth:      r.Auth,
+		}, nil
+	case BackendGitCLI:
+		return &gitCLI{
+			url:        r.URL,
+			path:       path,
+			depth:      r.Depth,
+			sparse:     r.Sparse,
+			submodule:  r.Submodule,
+			auth:       r.Auth,
+			sshCommand: r.SSHCommand,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q", r.Backend)
+	}
+}
@@ -0,0 +1,219 @@
+package caddy_webhook
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"go.uber.org/zap"
+)
+
+// testUpstream is a bare repository with a working clone to push
+// commits from.
+type testUpstream struct {
+	t        *testing.T
+	URL      string
+	work     string
+	worktree *git.Worktree
+	repo     *git.Repository
+}
+
+func newTestUpstream(t *testing.T, dir string) *testUpstream {
+	bare := filepath.Join(dir, "upstream.git")
+	_, err := git.PlainInit(bare, true)
+	assert.Nil(t, err)
+
+	work := filepath.Join(dir, "work")
+	repo, err := git.PlainInit(work, false)
+	assert.Nil(t, err)
+	_, err = repo.CreateRemote(&config.RemoteConfig{
+		Name: DefaultRemote,
+		URLs: []string{bare},
+	})
+	assert.Nil(t, err)
+
+	worktree, err := repo.Worktree()
+	assert.Nil(t, err)
+
+	return &testUpstream{t: t, URL: bare, work: work, worktree: worktree, repo: repo}
+}
+
+// commit commits files and pushes them to the main branch.
+func (u *testUpstream) commit(files map[string]string) plumbing.Hash {
+	for name, content := range files {
+		path := filepath.Join(u.work, name)
+		assert.Nil(u.t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(u.t, ioutil.WriteFile(path, []byte(content), 0644))
+		_, err := u.worktree.Add(name)
+		assert.Nil(u.t, err)
+	}
+
+	hash, err := u.worktree.Commit("update", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	assert.Nil(u.t, err)
+
+	u.push("refs/heads/master:refs/heads/main")
+	return hash
+}
+
+// tag tags HEAD and pushes the tag.
+func (u *testUpstream) tag(name string) {
+	head, err := u.repo.Head()
+	assert.Nil(u.t, err)
+	_, err = u.repo.CreateTag(name, head.Hash(), nil)
+	assert.Nil(u.t, err)
+
+	u.push(fmt.Sprintf("refs/tags/%s:refs/tags/%s", name, name))
+}
+
+func (u *testUpstream) push(refSpec string) {
+	err := u.repo.Push(&git.PushOptions{
+		RemoteName: DefaultRemote,
+		RefSpecs:   []config.RefSpec{config.RefSpec(refSpec)},
+	})
+	if err != git.NoErrAlreadyUpToDate {
+		assert.Nil(u.t, err)
+	}
+}
+
+func testBackends(t *testing.T, test func(t *testing.T, backend string)) {
+	for _, backend := range []string{BackendGoGit, BackendGitCLI} {
+		t.Run(backend, func(t *testing.T) {
+			if backend == BackendGitCLI {
+				if _, err := exec.LookPath("git"); err != nil {
+					t.Skip("git not found")
+				}
+			}
+			test(t, backend)
+		})
+	}
+}
+
+func TestBackend(t *testing.T) {
+	testBackends(t, func(t *testing.T, backend string) {
+		dir, err := ioutil.TempDir("", "webhook-backend")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		upstream := newTestUpstream(t, dir)
+		first := upstream.commit(map[string]string{"index.html": "first"})
+
+		path := filepath.Join(dir, "deploy")
+		r := &Repo{
+			URL:     upstream.URL,
+			Path:    path,
+			Backend: backend,
+			log:     zap.NewNop(),
+		}
+
+		read := func() string {
+			content, err := ioutil.ReadFile(filepath.Join(path, "index.html"))
+			assert.Nil(t, err)
+			return string(content)
+		}
+
+		ctx := context.Background()
+		assert.Nil(t, r.Setup(ctx))
+		assert.Equal(t, "first", read())
+
+		head, err := r.backend.Head(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, first, head)
+
+		// Pull the latest commit.
+		second := upstream.commit(map[string]string{"index.html": "second"})
+		assert.Nil(t, r.Update(ctx, ""))
+		assert.Equal(t, "second", read())
+
+		head, err = r.backend.Head(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, second, head)
+
+		assert.Equal(t, git.NoErrAlreadyUpToDate, r.Update(ctx, ""))
+
+		// Check out a given commit, which must follow the checked out one.
+		third := upstream.commit(map[string]string{"index.html": "third"})
+		upstream.commit(map[string]string{"index.html": "fourth"})
+		assert.Nil(t, r.Update(ctx, third.String()))
+		assert.Equal(t, "third", read())
+		assert.Equal(t, git.NoErrAlreadyUpToDate, r.Update(ctx, third.String()))
+
+		// Redelivered or reordered events never move back.
+		assert.NotNil(t, r.Update(ctx, first.String()))
+		assert.Equal(t, "third", read())
+
+		// Open the existing repository.
+		upstream.commit(map[string]string{"index.html": "fifth"})
+		r = &Repo{
+			URL:     upstream.URL,
+			Path:    path,
+			Backend: backend,
+			log:     zap.NewNop(),
+		}
+		assert.Nil(t, r.Setup(ctx))
+		assert.Equal(t, "fifth", read())
+	})
+}
+
+func TestBackendTag(t *testing.T) {
+	testBackends(t, func(t *testing.T, backend string) {
+		dir, err := ioutil.TempDir("", "webhook-backend")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		upstream := newTestUpstream(t, dir)
+		upstream.commit(map[string]string{"index.html": "v1"})
+		upstream.tag("v1")
+		upstream.commit(map[string]string{"index.html": "v2"})
+
+		path := filepath.Join(dir, "deploy")
+		r := &Repo{
+			URL:     upstream.URL,
+			Path:    path,
+			Branch:  "v1",
+			Backend: backend,
+			log:     zap.NewNop(),
+		}
+
+		assert.Nil(t, r.Setup(context.Background()))
+		assert.Equal(t, plumbing.NewTagReferenceName("v1"), r.refName)
+
+		content, err := ioutil.ReadFile(filepath.Join(path, "index.html"))
+		assert.Nil(t, err)
+		assert.Equal(t, "v1", string(content))
+	})
+}
+
+func TestGitCLIEnv(t *testing.T) {
+	auth := &githttp.BasicAuth{Username: "git", Password: "token"}
+
+	for i, tc := range []struct {
+		url string
+		key string
+	}{
+		{"https://github.com/WingLim/blog.git", "GIT_CONFIG_KEY_0=http.https://github.com/WingLim/blog.git.extraHeader"},
+		{"https://user@example.com:8443/blog", "GIT_CONFIG_KEY_0=http.https://example.com:8443/blog.extraHeader"},
+		{"git@github.com:WingLim/blog.git", ""},
+	} {
+		g := &gitCLI{url: tc.url, auth: auth}
+		env := g.env()
+		if tc.key == "" {
+			assert.Equal(t, []string{"GIT_TERMINAL_PROMPT=0"}, env, fmt.Sprintf("case %d", i))
+			continue
+		}
+		assert.Contains(t, env, tc.key, fmt.Sprintf("case %d", i))
+		assert.Contains(t, env, "GIT_CONFIG_VALUE_0=Authorization: Basic Z2l0OnRva2Vu", fmt.Sprintf("case %d", i))
+	}
+}
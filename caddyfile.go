@@ -1,9 +1,12 @@
 package caddy_webhook
 
 import (
+	"strconv"
+
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 )
 
 func parseHandlerCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
@@ -19,17 +22,54 @@ func parseHandlerCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler,
 //	Syntax:
 //
 //		webhook [<url> <path>] {
-//			repo		<text>
+//			repo		<text> [{
+//				<option>...
+//			}]
+//			repo_name	<text>
+//			image		<text>
 //			path 		<text>
 //			branch 		<text>
 //			depth		<int>
+//			sparse		<text>...
 //			type 		<text>
+//			trigger		<text>
+//			workflow	<text>
 //			secret		<text>
+//			allow_ips	<text>...
+//			trusted_proxies	<text>...
+//			ip_ranges_url	<source> <url>
+//			sns_cert	<text>
+//			sns_topics	<text>...
+//			sns_urls	<text>...
+//			skip_if_message	<text>...
+//			paths		<text>...
+//			paths_ignore	<text>...
+//			events		<text>...
 //			command		<text>...
 //			key			<text>
+//			key_data	<text>
+//			ssh_agent
+//			ssh_user	<text>
+//			known_hosts	<text>
+//			host_key	<text>
+//			insecure_ignore_host_key
 //			username	<text>
 //			password	<text>
 //			token		<text>
+//			github_app {
+//				app_id			<int>
+//				installation_id	<int>
+//				private_key		<text>
+//				api_url			<text>
+//			}
+//			previews	<text>
+//			previews_forks
+//			wait
+//			passthrough
+//			max_body_size	<size>
+//			lfs
+//			lfs_url		<text>
+//			backend		<text>
 //			submodule
 //		}
 func (w *WebHook) UnmarshlCaddyfile(d *caddyfile.Dispenser) error {
@@ -42,63 +82,259 @@ func (w *WebHook) UnmarshlCaddyfile(d *caddyfile.Dispenser) error {
 	}
 
 	for d.NextBlock(0) {
-		switch d.Val() {
-		case "repo":
-			if w.Repository != "" {
-				return d.Err("url specified twice")
-			}
-			if !d.Args(&w.Repository) {
-				return d.ArgErr()
-			}
-		case "path":
-			if w.Path != "" {
-				return d.Err("path specified twice")
-			}
-			if !d.Args(&w.Path) {
-				return d.ArgErr()
-			}
-		case "branch":
-			if !d.Args(&w.Branch) {
-				return d.ArgErr()
-			}
-		case "depth":
-			if !d.Args(&w.Depth) {
-				return d.ArgErr()
-			}
-		case "type":
-			if !d.Args(&w.Type) {
-				return d.ArgErr()
-			}
-		case "secret":
-			if !d.Args(&w.Secret) {
-				return d.ArgErr()
-			}
-		case "submodule":
-			w.Submodule = true
-		case "command":
-			w.Command = d.RemainingArgs()
-		case "key":
-			if !d.Args(&w.Key) {
-				return d.ArgErr()
-			}
-		case "key_password":
-			if !d.Args(&w.KeyPassword) {
-				return d.ArgErr()
+		if err := w.unmarshalOption(d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unmarshalOption configures the option of the handler directive at
+// the cursor of d.
+func (w *WebHook) unmarshalOption(d *caddyfile.Dispenser) error {
+	switch d.Val() {
+	case "repo":
+		var repo string
+		if !d.Args(&repo) {
+			return d.ArgErr()
+		}
+
+		// A repo with a block is one of several repositories
+		// served by the handler.
+		webhook := &WebHook{Repository: repo}
+		var block bool
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			block = true
+			if d.Val() == "repo" {
+				return d.Err("repo cannot be nested")
 			}
-		case "username":
-			if !d.Args(&w.Username) {
-				return d.ArgErr()
+			if err := webhook.unmarshalOption(d); err != nil {
+				return err
 			}
-		case "password":
-			if !d.Args(&w.Password) {
-				return d.ArgErr()
+		}
+		if block {
+			w.Repos = append(w.Repos, webhook)
+			break
+		}
+
+		if w.Repository != "" {
+			return d.Err("url specified twice")
+		}
+		w.Repository = repo
+	case "repo_name":
+		if !d.Args(&w.RepoName) {
+			return d.ArgErr()
+		}
+	case "image":
+		if !d.Args(&w.Image) {
+			return d.ArgErr()
+		}
+	case "path":
+		if w.Path != "" {
+			return d.Err("path specified twice")
+		}
+		if !d.Args(&w.Path) {
+			return d.ArgErr()
+		}
+	case "branch":
+		if !d.Args(&w.Branch) {
+			return d.ArgErr()
+		}
+	case "depth":
+		if !d.Args(&w.Depth) {
+			return d.ArgErr()
+		}
+	case "sparse":
+		w.Sparse = append(w.Sparse, d.RemainingArgs()...)
+		if len(w.Sparse) == 0 {
+			return d.ArgErr()
+		}
+	case "type":
+		if !d.Args(&w.Type) {
+			return d.ArgErr()
+		}
+	case "trigger":
+		if !d.Args(&w.Trigger) {
+			return d.ArgErr()
+		}
+	case "workflow":
+		if !d.Args(&w.Workflow) {
+			return d.ArgErr()
+		}
+	case "secret":
+		if !d.Args(&w.Secret) {
+			return d.ArgErr()
+		}
+	case "allow_ips":
+		w.AllowIPs = append(w.AllowIPs, d.RemainingArgs()...)
+		if len(w.AllowIPs) == 0 {
+			return d.ArgErr()
+		}
+	case "ip_ranges_url":
+		var name, url string
+		if !d.Args(&name, &url) {
+			return d.ArgErr()
+		}
+		if w.IPRangesURLs == nil {
+			w.IPRangesURLs = make(map[string]string)
+		}
+		w.IPRangesURLs[name] = url
+	case "trusted_proxies":
+		w.TrustedProxies = append(w.TrustedProxies, d.RemainingArgs()...)
+		if len(w.TrustedProxies) == 0 {
+			return d.ArgErr()
+		}
+	case "sns_cert":
+		if !d.Args(&w.SNSCert) {
+			return d.ArgErr()
+		}
+	case "sns_topics":
+		w.SNSTopics = append(w.SNSTopics, d.RemainingArgs()...)
+		if len(w.SNSTopics) == 0 {
+			return d.ArgErr()
+		}
+	case "sns_urls":
+		w.SNSURLs = append(w.SNSURLs, d.RemainingArgs()...)
+		if len(w.SNSURLs) == 0 {
+			return d.ArgErr()
+		}
+	case "skip_if_message":
+		w.SkipIfMessage = append(w.SkipIfMessage, d.RemainingArgs()...)
+		if len(w.SkipIfMessage) == 0 {
+			return d.ArgErr()
+		}
+	case "paths":
+		w.Paths = append(w.Paths, d.RemainingArgs()...)
+		if len(w.Paths) == 0 {
+			return d.ArgErr()
+		}
+	case "paths_ignore":
+		w.PathsIgnore = append(w.PathsIgnore, d.RemainingArgs()...)
+		if len(w.PathsIgnore) == 0 {
+			return d.ArgErr()
+		}
+	case "events":
+		w.Events = append(w.Events, d.RemainingArgs()...)
+		if len(w.Events) == 0 {
+			return d.ArgErr()
+		}
+	case "backend":
+		if !d.Args(&w.Backend) {
+			return d.ArgErr()
+		}
+	case "submodule":
+		w.Submodule = true
+	case "lfs":
+		w.LFS = true
+	case "lfs_url":
+		if !d.Args(&w.LFSURL) {
+			return d.ArgErr()
+		}
+	case "command":
+		w.Command = d.RemainingArgs()
+	case "key":
+		if !d.Args(&w.Key) {
+			return d.ArgErr()
+		}
+	case "key_password":
+		if !d.Args(&w.KeyPassword) {
+			return d.ArgErr()
+		}
+	case "key_data":
+		if !d.Args(&w.KeyData) {
+			return d.ArgErr()
+		}
+	case "ssh_agent":
+		w.SSHAgent = true
+	case "ssh_user":
+		if !d.Args(&w.SSHUser) {
+			return d.ArgErr()
+		}
+	case "known_hosts":
+		if !d.Args(&w.KnownHosts) {
+			return d.ArgErr()
+		}
+	case "host_key":
+		if !d.Args(&w.HostKey) {
+			return d.ArgErr()
+		}
+	case "insecure_ignore_host_key":
+		w.InsecureIgnoreHostKey = true
+	case "username":
+		if !d.Args(&w.Username) {
+			return d.ArgErr()
+		}
+	case "password":
+		if !d.Args(&w.Password) {
+			return d.ArgErr()
+		}
+	case "token":
+		if !d.Args(&w.Token) {
+			return d.ArgErr()
+		}
+	case "github_app":
+		w.GitHubApp = new(GitHubApp)
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			var err error
+			switch d.Val() {
+			case "app_id":
+				err = parseInt64(d, &w.GitHubApp.AppID)
+			case "installation_id":
+				err = parseInt64(d, &w.GitHubApp.InstallationID)
+			case "private_key":
+				if !d.Args(&w.GitHubApp.PrivateKey) {
+					return d.ArgErr()
+				}
+			case "api_url":
+				if !d.Args(&w.GitHubApp.APIURL) {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("unknown github_app option %q", d.Val())
 			}
-		case "token":
-			if !d.Args(&w.Token) {
-				return d.ArgErr()
+			if err != nil {
+				return err
 			}
 		}
+	case "previews":
+		if !d.Args(&w.Previews) {
+			return d.ArgErr()
+		}
+	case "previews_forks":
+		w.PreviewsForks = true
+	case "wait":
+		w.Wait = true
+	case "passthrough":
+		w.Passthrough = true
+	case "max_body_size":
+		var size string
+		if !d.Args(&size) {
+			return d.ArgErr()
+		}
+		n, err := humanize.ParseBytes(size)
+		if err != nil {
+			return d.Errf("invalid max_body_size %q: %v", size, err)
+		}
+		w.MaxBodySize = int64(n)
 	}
 
 	return nil
 }
+
+// parseInt64 parses the next argument as an int64 into v.
+func parseInt64(d *caddyfile.Dispenser, v *int64) error {
+	name := d.Val()
+
+	var arg string
+	if !d.Args(&arg) {
+		return d.ArgErr()
+	}
+
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return d.Errf("invalid %s %q: %v", name, arg, err)
+	}
+	*v = n
+	return nil
+}
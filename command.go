@@ -1,15 +1,25 @@
 package caddy_webhook
 
 import (
+	"bytes"
+	"fmt"
+	"os"
 	"os/exec"
 
 	"go.uber.org/zap"
 )
 
+// maxCommandOutput is the size of the end of the output of a failed
+// command which is kept in its error, and of the longest line logged.
+const maxCommandOutput = 1024
+
 type Cmd struct {
 	Command string
 	Args    []string
 	Path    string
+
+	// Env holds environment variables added to those of the process.
+	Env []string
 }
 
 func (c *Cmd) AddCommand(command []string, path string) {
@@ -18,17 +28,79 @@ func (c *Cmd) AddCommand(command []string, path string) {
 	c.Path = path
 }
 
-func (c *Cmd) Run(logger *zap.Logger) {
+// Run runs the command and waits for it to exit. The output is logged
+// line by line while it runs, and the error of a failed command tells
+// the end of its output.
+func (c *Cmd) Run(logger *zap.Logger) error {
 	cmdInfo := zap.Any("command", append([]string{c.Command}, c.Args...))
 	log := logger.With(cmdInfo)
 
 	cmd := exec.Command(c.Command, c.Args...)
 	cmd.Dir = c.Path
-	err := cmd.Start()
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+
+	// The same writer for both makes exec copy them in one goroutine.
+	output := &commandOutput{log: log}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	err := cmd.Run()
+	output.flush()
 	if err != nil {
-		log.Error(err.Error())
-	} else {
-		log.Info("run command successful")
+		if tail := bytes.TrimSpace(output.tail); len(tail) > 0 {
+			err = fmt.Errorf("%v: %s", err, tail)
+		}
+		log.Error("run command failed", zap.Error(err))
+		return err
+	}
+
+	log.Info("run command successful")
+	return nil
+}
+
+// commandOutput logs the output of a command line by line, and keeps
+// the last maxCommandOutput bytes of it.
+type commandOutput struct {
+	log  *zap.Logger
+	line []byte
+	tail []byte
+}
+
+// Write implements io.Writer.
+func (o *commandOutput) Write(p []byte) (int, error) {
+	o.tail = append(o.tail, p...)
+	if len(o.tail) > maxCommandOutput {
+		o.tail = append(o.tail[:0], o.tail[len(o.tail)-maxCommandOutput:]...)
+	}
+
+	o.line = append(o.line, p...)
+	for {
+		i := bytes.IndexByte(o.line, '\n')
+		if i < 0 {
+			break
+		}
+		o.logLine(o.line[:i])
+		o.line = o.line[i+1:]
+	}
+	if len(o.line) > maxCommandOutput {
+		o.flush()
+	}
+	return len(p), nil
+}
+
+// flush logs the rest of the output, which has no line ending.
+func (o *commandOutput) flush() {
+	if len(o.line) > 0 {
+		o.logLine(o.line)
+	}
+	o.line = nil
+}
+
+func (o *commandOutput) logLine(line []byte) {
+	line = bytes.TrimRight(line, "\r")
+	if len(line) > 0 {
+		o.log.Info("command output", zap.ByteString("line", line))
 	}
-	return
 }
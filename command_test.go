@@ -0,0 +1,57 @@
+package caddy_webhook
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestCmdOutput(t *testing.T) {
+	for i, tc := range []struct {
+		script string
+		lines  []string
+		err    string
+	}{
+		{`echo one; echo two >&2`, []string{"one", "two"}, ""},
+		{`printf 'no newline'`, []string{"no newline"}, ""},
+		{`echo built; echo broken >&2; exit 1`, []string{"built", "broken"}, "exit status 1: built\nbroken"},
+	} {
+		core, logs := observer.New(zapcore.InfoLevel)
+
+		cmd := &Cmd{}
+		cmd.AddCommand([]string{"sh", "-c", tc.script}, ".")
+		err := cmd.Run(zap.New(core))
+		if tc.err == "" {
+			assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		} else {
+			assert.Equal(t, tc.err, err.Error(), fmt.Sprintf("case %d", i))
+		}
+
+		var lines []string
+		for _, entry := range logs.FilterMessage("command output").All() {
+			lines = append(lines, entry.ContextMap()["line"].(string))
+		}
+		assert.Equal(t, tc.lines, lines, fmt.Sprintf("case %d", i))
+	}
+}
+
+func TestCmdOutputTail(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	// Every line is logged, and only the end is kept in the error.
+	cmd := &Cmd{}
+	cmd.AddCommand([]string{"sh", "-c", `i=0; while [ $i -lt 200 ]; do echo "line $i"; i=$((i+1)); done; exit 1`}, ".")
+	err := cmd.Run(zap.New(core))
+	assert.NotNil(t, err)
+	assert.Equal(t, 200, logs.FilterMessage("command output").Len())
+
+	msg := strings.TrimPrefix(err.Error(), "exit status 1: ")
+	assert.True(t, len(msg) <= maxCommandOutput)
+	assert.True(t, strings.HasSuffix(msg, "line 199"))
+	assert.False(t, strings.Contains(msg, "line 0\n"))
+}
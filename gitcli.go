@@ -0,0 +1,275 @@
+package caddy_webhook
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// gitCLI manages the repository with the git command, which supports
+// partial clone, credential helpers and the ssh configuration of the
+// system.
+type gitCLI struct {
+	url        string
+	path       string
+	depth      int
+	sparse     []string
+	submodule  git.SubmoduleRescursivity
+	auth       transport.AuthMethod
+	sshCommand string
+}
+
+func (g *gitCLI) RemoteRefs(ctx context.Context) ([]*plumbing.Reference, error) {
+	out, err := g.git(ctx, "", "ls-remote", g.url)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []*plumbing.Reference
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasSuffix(fields[1], "^{}") {
+			continue
+		}
+		refs = append(refs, plumbing.NewHashReference(
+			plumbing.ReferenceName(fields[1]),
+			plumbing.NewHash(fields[0]),
+		))
+	}
+	return refs, scanner.Err()
+}
+
+func (g *gitCLI) Setup(ctx context.Context, ref plumbing.ReferenceName) error {
+	if _, err := os.Stat(filepath.Join(g.path, git.GitDirName)); err == nil {
+		// If the path directory is a git repository, set up the remote as 'origin'
+		_, _ = g.git(ctx, g.path, "remote", "remove", DefaultRemote)
+		if _, err := g.git(ctx, g.path, "remote", "add", DefaultRemote, g.url); err != nil {
+			return err
+		}
+
+		if err := g.Fetch(ctx); err != nil {
+			return err
+		}
+	} else {
+		args := []string{"clone", "--origin", DefaultRemote, "--branch", ref.Short(), "--no-checkout"}
+		if g.depth > 0 {
+			args = append(args, "--depth", strconv.Itoa(g.depth))
+		}
+		if len(g.sparse) > 0 {
+			args = append(args, "--filter=blob:none")
+		}
+		args = append(args, g.url, g.path)
+
+		if _, err := g.git(ctx, "", args...); err != nil {
+			return err
+		}
+	}
+
+	if len(g.sparse) > 0 {
+		args := append([]string{"sparse-checkout", "set", "--cone"}, g.sparse...)
+		if _, err := g.git(ctx, g.path, args...); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if ref.IsBranch() {
+		remote := plumbing.NewRemoteReferenceName(DefaultRemote, ref.Short())
+		_, err = g.git(ctx, g.path, "checkout", "--force", "-B", ref.Short(), remote.String())
+	} else {
+		_, err = g.git(ctx, g.path, "checkout", "--force", "--detach", ref.String())
+	}
+	if err != nil {
+		return err
+	}
+	return g.updateSubmodules(ctx)
+}
+
+func (g *gitCLI) Fetch(ctx context.Context) error {
+	args := []string{"fetch", "--force", "--tags", DefaultRemote}
+	if g.depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(g.depth))
+	}
+
+	_, err := g.git(ctx, g.path, args...)
+	return err
+}
+
+func (g *gitCLI) Checkout(ctx context.Context, ref plumbing.ReferenceName, commit plumbing.Hash) error {
+	rev := commit.String()
+	if commit.IsZero() {
+		rev = ref.String()
+		if ref.IsBranch() {
+			rev = plumbing.NewRemoteReferenceName(DefaultRemote, ref.Short()).String()
+		}
+	}
+
+	var err error
+	if ref.IsBranch() {
+		_, err = g.git(ctx, g.path, "reset", "--hard", rev)
+	} else {
+		_, err = g.git(ctx, g.path, "checkout", "--force", "--detach", rev)
+	}
+	if err != nil {
+		return err
+	}
+	return g.updateSubmodules(ctx)
+}
+
+func (g *gitCLI) Pull(ctx context.Context, ref plumbing.ReferenceName) error {
+	args := []string{"pull", "--ff-only", DefaultRemote, ref.Short()}
+	if g.depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(g.depth))
+	}
+
+	if _, err := g.git(ctx, g.path, args...); err != nil {
+		return err
+	}
+	return g.updateSubmodules(ctx)
+}
+
+func (g *gitCLI) Head(ctx context.Context) (plumbing.Hash, error) {
+	out, err := g.git(ctx, g.path, "rev-parse", "HEAD")
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return plumbing.NewHash(strings.TrimSpace(string(out))), nil
+}
+
+func (g *gitCLI) Follows(ctx context.Context, commit, head plumbing.Hash) (bool, error) {
+	// merge-base fails without a common ancestor, which may be
+	// missing from a shallow repository.
+	out, err := g.git(ctx, g.path, "merge-base", head.String(), commit.String())
+	if err == nil {
+		return plumbing.NewHash(strings.TrimSpace(string(out))) == head, nil
+	}
+	if g.depth == 0 {
+		return false, nil
+	}
+
+	commitTime, err := g.commitTime(ctx, commit)
+	if err != nil {
+		return false, err
+	}
+	headTime, err := g.commitTime(ctx, head)
+	if err != nil {
+		return false, err
+	}
+	return commitTime >= headTime, nil
+}
+
+// commitTime returns the committer time of commit in Unix time.
+func (g *gitCLI) commitTime(ctx context.Context, commit plumbing.Hash) (int64, error) {
+	out, err := g.git(ctx, g.path, "show", "--no-patch", "--format=%ct", commit.String())
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+func (g *gitCLI) Preview(ctx context.Context, ref plumbing.ReferenceName) error {
+	if _, err := os.Stat(filepath.Join(g.path, git.GitDirName)); os.IsNotExist(err) {
+		if err := os.MkdirAll(g.path, 0755); err != nil {
+			return err
+		}
+		if _, err := g.git(ctx, g.path, "init", "--quiet"); err != nil {
+			return err
+		}
+		if _, err := g.git(ctx, g.path, "remote", "add", DefaultRemote, g.url); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	args := []string{"fetch", "--force"}
+	if g.depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(g.depth))
+	}
+	if len(g.sparse) > 0 {
+		args = append(args, "--filter=blob:none")
+	}
+	args = append(args, DefaultRemote, fmt.Sprintf("+%s:%s", ref, previewRef))
+	if _, err := g.git(ctx, g.path, args...); err != nil {
+		return err
+	}
+
+	if len(g.sparse) > 0 {
+		args := append([]string{"sparse-checkout", "set", "--cone"}, g.sparse...)
+		if _, err := g.git(ctx, g.path, args...); err != nil {
+			return err
+		}
+	}
+
+	if _, err := g.git(ctx, g.path, "checkout", "--force", "--detach", previewRef.String()); err != nil {
+		return err
+	}
+	return g.updateSubmodules(ctx)
+}
+
+func (g *gitCLI) updateSubmodules(ctx context.Context) error {
+	if g.submodule == git.NoRecurseSubmodules {
+		return nil
+	}
+
+	_, err := g.git(ctx, g.path, "submodule", "update", "--init", "--recursive")
+	return err
+}
+
+// git runs the git command in dir.
+func (g *gitCLI) git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), g.env()...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// env returns the environment variables passing the credentials to git.
+func (g *gitCLI) env() []string {
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+
+	if g.sshCommand != "" {
+		env = append(env, "GIT_SSH_COMMAND="+g.sshCommand)
+	}
+
+	// Pass http credentials as an extra header through the environment,
+	// so they are neither on the command line nor in the git config.
+	// The header is scoped to the URL of the repository, so it is not
+	// sent to submodules or after redirects to other hosts.
+	if auth, ok := g.auth.(githttp.AuthMethod); ok {
+		req := &http.Request{Header: http.Header{}}
+		auth.SetAuth(req)
+		u, err := url.Parse(g.url)
+		if header := req.Header.Get("Authorization"); header != "" && err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			u.User = nil
+			env = append(env,
+				"GIT_CONFIG_COUNT=1",
+				"GIT_CONFIG_KEY_0=http."+u.String()+".extraHeader",
+				"GIT_CONFIG_VALUE_0=Authorization: "+header,
+			)
+		}
+	}
+	return env
+}
@@ -0,0 +1,204 @@
+package caddy_webhook
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultGitHubAPIURL is the GitHub REST API of github.com.
+	DefaultGitHubAPIURL = "https://api.github.com"
+
+	githubAppAuthName = "github-app"
+
+	// githubTokenRefresh is how long before its expiry an
+	// installation token is refreshed.
+	githubTokenRefresh = 5 * time.Minute
+)
+
+// GitHubApp authenticates as an installation of a GitHub App, with
+// short-lived installation tokens minted from the app's private key.
+type GitHubApp struct {
+	// ID of the GitHub App.
+	AppID int64 `json:"app_id,omitempty"`
+
+	// ID of the installation of the GitHub App on the account
+	// owning the repository.
+	InstallationID int64 `json:"installation_id,omitempty"`
+
+	// PEM encoded private key of the GitHub App. It can be read from
+	// placeholders, such as `{file./run/secrets/app.pem}`.
+	PrivateKey string `json:"private_key,omitempty"`
+
+	// GitHub REST API URL.
+	// Default to `https://api.github.com`.
+	APIURL string `json:"api_url,omitempty"`
+
+	client *http.Client
+	key    *rsa.PrivateKey
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// provision parses the private key of the app.
+func (a *GitHubApp) provision() error {
+	if a.APIURL == "" {
+		a.APIURL = DefaultGitHubAPIURL
+	}
+	a.APIURL = strings.TrimSuffix(a.APIURL, "/")
+
+	if a.client == nil {
+		a.client = http.DefaultClient
+	}
+
+	data, err := resolveCredential(a.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("private key: %v", err)
+	}
+
+	a.key, err = parseRSAPrivateKey([]byte(data))
+	return err
+}
+
+// Name implements transport.AuthMethod.
+func (a *GitHubApp) Name() string {
+	return githubAppAuthName
+}
+
+// String implements transport.AuthMethod.
+func (a *GitHubApp) String() string {
+	return fmt.Sprintf("%s - app: %d, installation: %d", a.Name(), a.AppID, a.InstallationID)
+}
+
+// SetAuth implements githttp.AuthMethod with the installation token.
+func (a *GitHubApp) SetAuth(r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" {
+		r.SetBasicAuth("x-access-token", a.token)
+	}
+}
+
+// Refresh mints a new installation token if the current one is about
+// to expire.
+func (a *GitHubApp) Refresh(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if a.token != "" && now.Add(githubTokenRefresh).Before(a.expiresAt) {
+		return nil
+	}
+
+	jwt, err := a.jwt(now)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", a.APIURL, a.InstallationID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("cannot create installation token: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+	if token.Token == "" {
+		return fmt.Errorf("cannot create installation token: empty token")
+	}
+
+	a.token = token.Token
+	a.expiresAt = token.ExpiresAt
+	return nil
+}
+
+// jwt creates the JSON Web Token authenticating as the app, signed
+// with RS256.
+func (a *GitHubApp) jwt(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Issued a minute ago to allow for clock drift, and valid for the
+	// maximum of 10 minutes.
+	claims, err := json.Marshal(map[string]int64{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.AppID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + encoding.EncodeToString(signature), nil
+}
+
+// parseRSAPrivateKey parses a PKCS #1 or PKCS #8 PEM encoded RSA
+// private key.
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("private key is not PEM encoded")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not a RSA key")
+	}
+	return rsaKey, nil
+}
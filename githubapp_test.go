@@ -0,0 +1,122 @@
+package caddy_webhook
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+)
+
+func TestGitHubApp(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	keyData := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}))
+
+	// A stand-in GitHub API minting installation tokens.
+	var tokens int
+	status := http.StatusCreated
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/app/installations/42/access_tokens", r.URL.Path)
+
+		// Verify the JWT signed by the app.
+		jwt := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		parts := strings.Split(jwt, ".")
+		assert.Equal(t, 3, len(parts))
+
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		assert.Nil(t, err)
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		assert.Nil(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		assert.Nil(t, err)
+		var claims struct {
+			Iss int64 `json:"iss"`
+			Iat int64 `json:"iat"`
+			Exp int64 `json:"exp"`
+		}
+		assert.Nil(t, json.Unmarshal(payload, &claims))
+		assert.Equal(t, int64(1234), claims.Iss)
+		assert.True(t, claims.Exp-claims.Iat <= 600)
+
+		if status != http.StatusCreated {
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(`{"message": "Bad credentials"}`))
+			return
+		}
+
+		tokens++
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token": "ghs_%d", "expires_at": %q}`,
+			tokens, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer server.Close()
+
+	app := &GitHubApp{
+		AppID:          1234,
+		InstallationID: 42,
+		PrivateKey:     keyData,
+		APIURL:         server.URL + "/",
+	}
+	assert.Nil(t, app.provision())
+
+	ctx := context.Background()
+	assert.Nil(t, app.Refresh(ctx))
+
+	req := &http.Request{Header: http.Header{}}
+	app.SetAuth(req)
+	user, pass, ok := req.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "x-access-token", user)
+	assert.Equal(t, "ghs_1", pass)
+
+	// The token is reused until it is about to expire.
+	assert.Nil(t, app.Refresh(ctx))
+	assert.Equal(t, 1, tokens)
+
+	app.expiresAt = time.Now().Add(time.Minute)
+	assert.Nil(t, app.Refresh(ctx))
+	assert.Equal(t, 2, tokens)
+
+	app.expiresAt = time.Now()
+	status = http.StatusUnauthorized
+	err = app.Refresh(ctx)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Bad credentials")
+}
+
+func TestParseRSAPrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, err)
+
+	for i, tc := range []struct {
+		data string
+		err  bool
+	}{
+		{string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})), false},
+		{string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})), false},
+		{"not a key", true},
+	} {
+		_, err := parseRSAPrivateKey([]byte(tc.data))
+		assert.Equal(t, tc.err, err != nil, fmt.Sprintf("case %d", i))
+	}
+}
@@ -5,7 +5,9 @@ go 1.16
 require (
 	github.com/alecthomas/assert v0.0.0-20170929043011-405dbfeb8e38
 	github.com/caddyserver/caddy/v2 v2.3.0
+	github.com/dustin/go-humanize v1.0.1-0.20200219035652-afde56e7acac
 	github.com/go-git/go-git/v5 v5.3.0
 	github.com/stretchr/testify v1.7.0 // indirect
 	go.uber.org/zap v1.16.0
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 )
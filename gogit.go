@@ -0,0 +1,284 @@
+package caddy_webhook
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// goGit manages the repository with go-git.
+type goGit struct {
+	url       string
+	path      string
+	depth     int
+	sparse    []string
+	submodule git.SubmoduleRescursivity
+	auth      transport.AuthMethod
+
+	repo *git.Repository
+}
+
+func (g *goGit) RemoteRefs(ctx context.Context) ([]*plumbing.Reference, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: DefaultRemote,
+		URLs: []string{g.url},
+	})
+
+	return remote.List(&git.ListOptions{
+		Auth: g.auth,
+	})
+}
+
+func (g *goGit) Setup(ctx context.Context, ref plumbing.ReferenceName) error {
+	var err error
+	g.repo, err = git.PlainOpen(g.path)
+	if err == nil {
+		// If the path directory is a git repository, set up the remote as 'origin'
+		err = g.repo.DeleteRemote(DefaultRemote)
+		if err != nil && err != git.ErrRemoteNotFound {
+			return err
+		}
+
+		_, err = g.repo.CreateRemote(&config.RemoteConfig{
+			Name: DefaultRemote,
+			URLs: []string{g.url},
+		})
+		if err != nil {
+			return err
+		}
+
+		err = g.Fetch(ctx)
+		if err != nil {
+			return err
+		}
+
+		if ref.IsBranch() && len(g.sparse) == 0 {
+			err = g.checkoutBranch(ref)
+			if err != nil {
+				return err
+			}
+		}
+		return g.Checkout(ctx, ref, plumbing.ZeroHash)
+	} else if err == git.ErrRepositoryNotExists {
+		// If the path directory is not a git repository, clone it from url.
+		g.repo, err = git.PlainCloneContext(ctx, g.path, false, &git.CloneOptions{
+			URL:               g.url,
+			Auth:              g.auth,
+			RemoteName:        DefaultRemote,
+			ReferenceName:     ref,
+			Depth:             g.depth,
+			RecurseSubmodules: g.submodule,
+			Tags:              git.AllTags,
+			NoCheckout:        len(g.sparse) > 0,
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(g.sparse) > 0 {
+			head, err := g.repo.Head()
+			if err != nil {
+				return err
+			}
+			return g.sparseCheckout(plumbing.ZeroHash, head.Hash())
+		}
+		return nil
+	}
+	return err
+}
+
+func (g *goGit) Fetch(ctx context.Context) error {
+	if err := g.repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: DefaultRemote,
+		Depth:      g.depth,
+		Auth:       g.auth,
+		Tags:       git.AllTags,
+	}); err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+	return nil
+}
+
+func (g *goGit) Checkout(ctx context.Context, ref plumbing.ReferenceName, commit plumbing.Hash) error {
+	if commit.IsZero() {
+		name := ref
+		if name.IsBranch() {
+			name = plumbing.NewRemoteReferenceName(DefaultRemote, name.Short())
+		}
+
+		hash, err := g.repo.ResolveRevision(plumbing.Revision(name))
+		if err != nil {
+			return err
+		}
+		commit = *hash
+	}
+
+	if len(g.sparse) > 0 {
+		err := g.sparseUpdate(ref, commit)
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			return err
+		}
+		return nil
+	}
+
+	worktree, err := g.repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	if !ref.IsBranch() {
+		return worktree.Checkout(&git.CheckoutOptions{
+			Hash:  commit,
+			Force: true,
+		})
+	}
+	return worktree.Reset(&git.ResetOptions{
+		Commit: commit,
+		Mode:   git.HardReset,
+	})
+}
+
+func (g *goGit) Pull(ctx context.Context, ref plumbing.ReferenceName) error {
+	if len(g.sparse) > 0 {
+		if err := g.Fetch(ctx); err != nil {
+			return err
+		}
+		return g.Checkout(ctx, ref, plumbing.ZeroHash)
+	}
+
+	worktree, err := g.repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	return worktree.PullContext(ctx, &git.PullOptions{
+		RemoteName:    DefaultRemote,
+		ReferenceName: ref,
+		Depth:         g.depth,
+		Auth:          g.auth,
+	})
+}
+
+func (g *goGit) Head(ctx context.Context) (plumbing.Hash, error) {
+	head, err := g.repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return head.Hash(), nil
+}
+
+func (g *goGit) Follows(ctx context.Context, commit, head plumbing.Hash) (bool, error) {
+	c, err := g.repo.CommitObject(commit)
+	if err != nil {
+		return false, err
+	}
+	h, err := g.repo.CommitObject(head)
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := h.IsAncestor(c)
+	if err == plumbing.ErrObjectNotFound && g.depth > 0 {
+		return !c.Committer.When.Before(h.Committer.When), nil
+	}
+	return ok, err
+}
+
+func (g *goGit) Preview(ctx context.Context, ref plumbing.ReferenceName) error {
+	var err error
+	g.repo, err = git.PlainOpen(g.path)
+	if err == git.ErrRepositoryNotExists {
+		g.repo, err = git.PlainInit(g.path, false)
+		if err != nil {
+			return err
+		}
+
+		_, err = g.repo.CreateRemote(&config.RemoteConfig{
+			Name: DefaultRemote,
+			URLs: []string{g.url},
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	refSpec := config.RefSpec(fmt.Sprintf("+%s:%s", ref, previewRef))
+	if err := g.repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: DefaultRemote,
+		RefSpecs:   []config.RefSpec{refSpec},
+		Depth:      g.depth,
+		Auth:       g.auth,
+		Force:      true,
+	}); err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+
+	head, err := g.repo.Reference(previewRef, true)
+	if err != nil {
+		return err
+	}
+
+	if len(g.sparse) > 0 {
+		err := g.sparseUpdate(plumbing.HEAD, head.Hash())
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			return err
+		}
+		return nil
+	}
+
+	worktree, err := g.repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	err = worktree.Checkout(&git.CheckoutOptions{
+		Hash:  head.Hash(),
+		Force: true,
+	})
+	if err != nil || g.submodule == git.NoRecurseSubmodules {
+		return err
+	}
+
+	submodules, err := worktree.Submodules()
+	if err != nil {
+		return err
+	}
+	return submodules.UpdateContext(ctx, &git.SubmoduleUpdateOptions{
+		Init:              true,
+		RecurseSubmodules: g.submodule,
+		Auth:              g.auth,
+	})
+}
+
+// checkoutBranch switches to the branch ref, which is created from
+// the remote branch if missing.
+func (g *goGit) checkoutBranch(ref plumbing.ReferenceName) error {
+	worktree, err := g.repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	opts := &git.CheckoutOptions{
+		Branch: ref,
+		Force:  true,
+	}
+
+	_, err = g.repo.Reference(ref, false)
+	if err == plumbing.ErrReferenceNotFound {
+		remote, err := g.repo.Reference(plumbing.NewRemoteReferenceName(DefaultRemote, ref.Short()), true)
+		if err != nil {
+			return err
+		}
+		opts.Create = true
+		opts.Hash = remote.Hash()
+	} else if err != nil {
+		return err
+	}
+
+	return worktree.Checkout(opts)
+}
@@ -0,0 +1,52 @@
+package caddy_webhook
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newHostKeyCallback creates the callback verifying the host key of
+// the ssh server against the known_hosts file and the pinned
+// fingerprint. Both are checked if given.
+func newHostKeyCallback(knownHostsFile, hostKey string) (ssh.HostKeyCallback, error) {
+	var callbacks []ssh.HostKeyCallback
+
+	if knownHostsFile != "" {
+		callback, err := knownhosts.New(knownHostsFile)
+		if err != nil {
+			return nil, err
+		}
+		callbacks = append(callbacks, callback)
+	}
+
+	if hostKey != "" {
+		fingerprint := normalizeFingerprint(hostKey)
+		callbacks = append(callbacks, func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if ssh.FingerprintSHA256(key) != fingerprint {
+				return fmt.Errorf("host key does not match %s", fingerprint)
+			}
+			return nil
+		})
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		for _, callback := range callbacks {
+			if err := callback(hostname, remote, key); err != nil {
+				return fmt.Errorf("cannot verify host key %s %s of %s: %v",
+					key.Type(), ssh.FingerprintSHA256(key), hostname, err)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// normalizeFingerprint adds the `SHA256:` prefix to fingerprint and
+// trims its base64 padding, as printed by `ssh-keygen -l`.
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.TrimRight(strings.TrimPrefix(fingerprint, "SHA256:"), "=")
+	return "SHA256:" + fingerprint
+}
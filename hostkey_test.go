@@ -0,0 +1,67 @@
+package caddy_webhook
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestHostKeyCallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook-hostkey")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	newKey := func() ssh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		assert.Nil(t, err)
+		key, err := ssh.NewPublicKey(pub)
+		assert.Nil(t, err)
+		return key
+	}
+	key, other := newKey(), newKey()
+
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{"github.com"}, key)
+	assert.Nil(t, ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0644))
+
+	fingerprint := ssh.FingerprintSHA256(key)
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+
+	for i, test := range []struct {
+		knownHosts string
+		hostKey    string
+		key        ssh.PublicKey
+		ok         bool
+	}{
+		{"", fingerprint, key, true},
+		{"", strings.TrimPrefix(fingerprint, "SHA256:"), key, true},
+		{"", fingerprint, other, false},
+		{knownHostsFile, "", key, true},
+		{knownHostsFile, "", other, false},
+		{knownHostsFile, fingerprint, key, true},
+		{knownHostsFile, ssh.FingerprintSHA256(other), other, false},
+	} {
+		callback, err := newHostKeyCallback(test.knownHosts, test.hostKey)
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+
+		err = callback("github.com:22", addr, test.key)
+		assert.Equal(t, test.ok, err == nil, fmt.Sprintf("case %d", i))
+		if err != nil {
+			// The error shows the offered fingerprint.
+			assert.Contains(t, err.Error(), ssh.FingerprintSHA256(test.key), fmt.Sprintf("case %d", i))
+		}
+	}
+
+	_, err = newHostKeyCallback(filepath.Join(dir, "not_exist"), "")
+	assert.NotNil(t, err)
+}
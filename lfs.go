@@ -0,0 +1,456 @@
+package caddy_webhook
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	lfsMediaType = "application/vnd.git-lfs+json"
+
+	// lfsPointerMaxSize is the largest size of a pointer file.
+	lfsPointerMaxSize = 1024
+
+	// lfsBatchSize is the number of objects requested at once.
+	lfsBatchSize = 100
+)
+
+// LFS downloads Git LFS objects of checked out files through the
+// LFS batch API, and caches them in `.git/lfs/objects`.
+type LFS struct {
+	URL    string
+	Auth   transport.AuthMethod
+	Client *http.Client
+
+	// Address and path of the repository on the ssh server, which
+	// tells the endpoint and the credentials for ssh remotes through
+	// `git-lfs-authenticate`.
+	sshAddr string
+	sshPath string
+}
+
+type lfsPointer struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+type lfsBatchRequest struct {
+	Operation string       `json:"operation"`
+	Transfers []string     `json:"transfers"`
+	Objects   []lfsPointer `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Objects []struct {
+		lfsPointer
+		Actions struct {
+			Download *struct {
+				Href   string            `json:"href"`
+				Header map[string]string `json:"header"`
+			} `json:"download"`
+		} `json:"actions"`
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"objects"`
+}
+
+// NewLFS creates a LFS client for the repository URL. The LFS endpoint
+// is derived from the repository URL unless endpoint is given.
+// With ssh auth, the endpoint and the credentials are asked from the
+// ssh server of the repository instead.
+func NewLFS(repoURL, endpoint string, auth transport.AuthMethod) (*LFS, error) {
+	l := &LFS{
+		Auth:   auth,
+		Client: http.DefaultClient,
+	}
+
+	if endpoint == "" {
+		var err error
+		endpoint, err = lfsEndpoint(repoURL)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := auth.(gitssh.AuthMethod); ok {
+			l.sshAddr, l.sshPath = lfsSSHRemote(repoURL)
+		}
+	}
+
+	l.URL = strings.TrimSuffix(endpoint, "/")
+	return l, nil
+}
+
+// Checkout replaces the LFS pointer files of HEAD inside dirs with
+// their objects, in the worktree at path.
+func (l *LFS) Checkout(ctx context.Context, repo *git.Repository, path string, dirs []string) error {
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+
+	files, err := treeFiles(repo, head.Hash(), dirs)
+	if err != nil {
+		return err
+	}
+
+	pointers := map[string]lfsPointer{}
+	for name, file := range files {
+		if file.Size > lfsPointerMaxSize {
+			continue
+		}
+		content, err := file.Contents()
+		if err != nil {
+			return err
+		}
+		if pointer, ok := parseLFSPointer(content); ok {
+			pointers[name] = pointer
+		}
+	}
+	if len(pointers) == 0 {
+		return nil
+	}
+
+	cache := filepath.Join(path, git.GitDirName, "lfs", "objects")
+
+	var missing []lfsPointer
+	seen := map[string]bool{}
+	for _, pointer := range pointers {
+		if seen[pointer.Oid] {
+			continue
+		}
+		seen[pointer.Oid] = true
+		if _, err := os.Stat(lfsCachePath(cache, pointer.Oid)); os.IsNotExist(err) {
+			missing = append(missing, pointer)
+		}
+	}
+
+	for len(missing) > 0 {
+		n := len(missing)
+		if n > lfsBatchSize {
+			n = lfsBatchSize
+		}
+		if err := l.download(ctx, cache, missing[:n]); err != nil {
+			return err
+		}
+		missing = missing[n:]
+	}
+
+	for name, pointer := range pointers {
+		dst := filepath.Join(path, filepath.FromSlash(name))
+		if info, err := os.Stat(dst); err == nil && info.Size() == pointer.Size && pointer.Size > lfsPointerMaxSize {
+			// Already replaced by the object.
+			continue
+		}
+		if err := copyFile(lfsCachePath(cache, pointer.Oid), dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// download fetches objects into the cache.
+func (l *LFS) download(ctx context.Context, cache string, objects []lfsPointer) error {
+	body, err := json.Marshal(&lfsBatchRequest{
+		Operation: "download",
+		Transfers: []string{"basic"},
+		Objects:   objects,
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoint, header := l.URL, map[string]string(nil)
+	if l.sshAddr != "" {
+		endpoint, header, err = l.sshAuthenticate()
+		if err != nil {
+			return fmt.Errorf("git-lfs-authenticate: %v", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	if auth, ok := l.Auth.(githttp.AuthMethod); ok {
+		auth.SetAuth(req)
+	}
+
+	resp, err := l.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("lfs batch request failed: HTTP %d", resp.StatusCode)
+	}
+
+	var batch lfsBatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return fmt.Errorf("cannot decode lfs batch response: %v", err)
+	}
+
+	requested := map[string]lfsPointer{}
+	for _, object := range objects {
+		requested[object.Oid] = object
+	}
+
+	for _, object := range batch.Objects {
+		if _, ok := requested[object.Oid]; !ok {
+			return fmt.Errorf("lfs object %q was not requested", object.Oid)
+		}
+		if object.Error != nil {
+			return fmt.Errorf("lfs object %s: %s", object.Oid, object.Error.Message)
+		}
+		if object.Actions.Download == nil {
+			return fmt.Errorf("lfs object %s: no download action", object.Oid)
+		}
+
+		action := object.Actions.Download
+		if err := l.fetch(ctx, action.Href, action.Header, cache, requested[object.Oid]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sshAuthenticate runs `git-lfs-authenticate` on the ssh server of the
+// repository, which tells the endpoint and the header to authenticate
+// with it.
+func (l *LFS) sshAuthenticate() (string, map[string]string, error) {
+	auth, ok := l.Auth.(gitssh.AuthMethod)
+	if !ok {
+		return "", nil, fmt.Errorf("no ssh auth")
+	}
+	config, err := auth.ClientConfig()
+	if err != nil {
+		return "", nil, err
+	}
+
+	client, err := gossh.Dial("tcp", l.sshAddr, config)
+	if err != nil {
+		return "", nil, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return "", nil, err
+	}
+	defer session.Close()
+
+	out, err := session.Output("git-lfs-authenticate " + shellQuote(l.sshPath) + " download")
+	if err != nil {
+		return "", nil, err
+	}
+
+	var resp struct {
+		Href   string            `json:"href"`
+		Header map[string]string `json:"header"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return "", nil, fmt.Errorf("cannot decode response: %v", err)
+	}
+	if resp.Href == "" {
+		return "", nil, fmt.Errorf("no href in response")
+	}
+	return strings.TrimSuffix(resp.Href, "/"), resp.Header, nil
+}
+
+// fetch downloads an object and verifies it before moving it into
+// the cache.
+func (l *LFS) fetch(ctx context.Context, href string, header map[string]string, cache string, pointer lfsPointer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, href, nil)
+	if err != nil {
+		return err
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := l.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot download lfs object %s: HTTP %d", pointer.Oid, resp.StatusCode)
+	}
+
+	dst := lfsCachePath(cache, pointer.Oid)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), pointer.Oid)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if size != pointer.Size || hex.EncodeToString(hash.Sum(nil)) != pointer.Oid {
+		return fmt.Errorf("lfs object %s is corrupted", pointer.Oid)
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// parseLFSPointer parses the content of a LFS pointer file.
+func parseLFSPointer(content string) (lfsPointer, bool) {
+	var pointer lfsPointer
+	var version bool
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			return pointer, false
+		}
+
+		switch fields[0] {
+		case "version":
+			version = fields[1] == "https://git-lfs.github.com/spec/v1" ||
+				fields[1] == "https://hawser.github.com/spec/v1"
+		case "oid":
+			oid := strings.TrimPrefix(fields[1], "sha256:")
+			if len(oid) != sha256.Size*2 || oid == fields[1] {
+				return pointer, false
+			}
+			if _, err := hex.DecodeString(oid); err != nil {
+				return pointer, false
+			}
+			pointer.Oid = oid
+		case "size":
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil || size < 0 {
+				return pointer, false
+			}
+			pointer.Size = size
+		}
+	}
+
+	return pointer, version && pointer.Oid != ""
+}
+
+// lfsEndpoint derives the LFS endpoint from the repository URL.
+func lfsEndpoint(repoURL string) (string, error) {
+	if strings.HasPrefix(repoURL, "http://") || strings.HasPrefix(repoURL, "https://") {
+		u, err := url.Parse(repoURL)
+		if err != nil {
+			return "", err
+		}
+		u.User = nil
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		if !strings.HasSuffix(u.Path, ".git") {
+			u.Path += ".git"
+		}
+		return u.String() + "/info/lfs", nil
+	}
+
+	addr, path := lfsSSHRemote(repoURL)
+	if addr == "" {
+		return "", fmt.Errorf("cannot derive lfs endpoint from %q", repoURL)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	path = strings.TrimSuffix(path, "/")
+	if !strings.HasSuffix(path, ".git") {
+		path += ".git"
+	}
+	return "https://" + host + "/" + path + "/info/lfs", nil
+}
+
+// lfsSSHRemote returns the address of the ssh server and the path of
+// the repository for ssh repository URLs, or empty for others.
+func lfsSSHRemote(repoURL string) (addr, path string) {
+	if strings.HasPrefix(repoURL, "ssh://") {
+		u, err := url.Parse(repoURL)
+		if err != nil {
+			return "", ""
+		}
+		port := u.Port()
+		if port == "" {
+			port = "22"
+		}
+		return net.JoinHostPort(u.Hostname(), port), strings.TrimPrefix(u.Path, "/")
+	}
+
+	// git@github.com:WingLim/caddy-webhook.git
+	if i := strings.Index(repoURL, ":"); i > 0 && strings.Contains(repoURL[:i], "@") {
+		host := repoURL[strings.Index(repoURL, "@")+1 : i]
+		return net.JoinHostPort(host, "22"), repoURL[i+1:]
+	}
+	return "", ""
+}
+
+// lfsCachePath returns the path of an object in the cache.
+func lfsCachePath(cache, oid string) string {
+	return filepath.Join(cache, oid[0:2], oid[2:4], oid)
+}
+
+// copyFile copies the file at src to dst, keeping the mode of dst.
+func copyFile(src, dst string) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Lstat(dst); err == nil {
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refuse to write lfs object to symlink %s", dst)
+		}
+		mode = info.Mode().Perm()
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
@@ -0,0 +1,95 @@
+package caddy_webhook
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/WingLim/caddy-webhook/webhooks"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"go.uber.org/zap"
+)
+
+// previewRef is the local reference which the head of a pull request
+// is fetched into.
+const previewRef = plumbing.ReferenceName("refs/heads/preview")
+
+// PreviewPath returns the directory of the preview for a pull request.
+func (r *Repo) PreviewPath(number int) string {
+	return filepath.Join(r.Previews, fmt.Sprintf("pr-%d", number))
+}
+
+// lockPreview locks the preview of a pull request, so events of the
+// same pull request do not update or remove its directory together.
+func (r *Repo) lockPreview(number int) func() {
+	r.previewMu.Lock()
+	if r.previewLocks == nil {
+		r.previewLocks = make(map[int]*sync.Mutex)
+	}
+	mu, ok := r.previewLocks[number]
+	if !ok {
+		mu = &sync.Mutex{}
+		r.previewLocks[number] = mu
+	}
+	r.previewMu.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
+// Preview checks out the head of the pull request into its preview
+// directory with the backend of the repository, and runs the command
+// there until it exits.
+func (r *Repo) Preview(ctx context.Context, pr *webhooks.PullRequest) error {
+	defer r.lockPreview(pr.Number)()
+
+	path := r.PreviewPath(pr.Number)
+
+	backend, err := newBackend(r, path)
+	if err != nil {
+		return err
+	}
+
+	if err := r.refreshAuth(ctx); err != nil {
+		return err
+	}
+
+	if err := backend.Preview(ctx, pr.Ref); err != nil {
+		return err
+	}
+
+	if r.LFS != nil {
+		repo, err := git.PlainOpen(path)
+		if err != nil {
+			return err
+		}
+		if err := r.LFS.Checkout(ctx, repo, path, r.Sparse); err != nil {
+			return err
+		}
+	}
+
+	head, err := backend.Head(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.log.Info("deploying preview successful",
+		zap.String("path", path),
+		zap.String("commit", head.String()))
+	if r.cmd != nil {
+		cmd := *r.cmd
+		cmd.Path = path
+		return cmd.Run(r.log)
+	}
+	return nil
+}
+
+// RemovePreview deletes the preview directory of a pull request.
+func (r *Repo) RemovePreview(number int) error {
+	defer r.lockPreview(number)()
+
+	return os.RemoveAll(r.PreviewPath(number))
+}
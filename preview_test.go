@@ -0,0 +1,88 @@
+package caddy_webhook
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/WingLim/caddy-webhook/webhooks"
+	"github.com/alecthomas/assert"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+)
+
+func TestPreview(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook-preview")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Create an upstream repository with the head of pull request 1.
+	upstream := filepath.Join(dir, "upstream")
+	repo, err := git.PlainInit(upstream, false)
+	assert.Nil(t, err)
+	worktree, err := repo.Worktree()
+	assert.Nil(t, err)
+
+	err = ioutil.WriteFile(filepath.Join(upstream, "index.html"), []byte("preview"), 0644)
+	assert.Nil(t, err)
+	_, err = worktree.Add("index.html")
+	assert.Nil(t, err)
+	hash, err := worktree.Commit("add index", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	assert.Nil(t, err)
+
+	pr := &webhooks.PullRequest{
+		Number: 1,
+		Ref:    plumbing.ReferenceName("refs/pull/1/head"),
+	}
+	err = repo.Storer.SetReference(plumbing.NewHashReference(pr.Ref, hash))
+	assert.Nil(t, err)
+
+	r := &Repo{
+		URL:      upstream,
+		Previews: filepath.Join(dir, "previews"),
+		log:      zap.NewNop(),
+	}
+
+	path := r.PreviewPath(pr.Number)
+	assert.Equal(t, filepath.Join(dir, "previews", "pr-1"), path)
+
+	err = r.Preview(context.Background(), pr)
+	assert.Nil(t, err)
+
+	content, err := ioutil.ReadFile(filepath.Join(path, "index.html"))
+	assert.Nil(t, err)
+	assert.Equal(t, "preview", string(content))
+
+	err = r.RemovePreview(pr.Number)
+	assert.Nil(t, err)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// Events of the same pull request arriving together are serialized.
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = r.Preview(context.Background(), pr)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+	}
+
+	content, err = ioutil.ReadFile(filepath.Join(path, "index.html"))
+	assert.Nil(t, err)
+	assert.Equal(t, "preview", string(content))
+}
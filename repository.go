@@ -3,12 +3,11 @@ package caddy_webhook
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/transport"
-	"github.com/go-git/go-git/v5/storage/memory"
 	"go.uber.org/zap"
 )
 
@@ -21,29 +20,56 @@ const (
 type Repo struct {
 	URL       string
 	Path      string
+	Previews  string
 	Branch    string
 	Depth     int
+	Sparse    []string
 	Secret    string
 	Submodule git.SubmoduleRescursivity
 	Auth      transport.AuthMethod
+	LFS       *LFS
 
-	repo    *git.Repository
+	// Backend managing the local repository, `go-git` or `git-cli`.
+	Backend string
+
+	// SSHCommand is the ssh command used by the git-cli backend.
+	SSHCommand string
+
+	backend Backend
 	log     *zap.Logger
 	cmd     *Cmd
 	refName plumbing.ReferenceName
+
+	// mu serializes updates and the command, so events arriving
+	// together do not update the worktree while the command runs.
+	mu sync.Mutex
+
+	// previewMu guards previewLocks, which serialize the deployment
+	// and removal of the preview of each pull request.
+	previewMu    sync.Mutex
+	previewLocks map[int]*sync.Mutex
+}
+
+// refresher is an auth method with expiring credentials, such as the
+// installation tokens of GitHub Apps.
+type refresher interface {
+	Refresh(ctx context.Context) error
 }
 
 // NewRepo creates a new repo with options.
 func NewRepo(w *WebHook) *Repo {
 	r := &Repo{
-		URL:    w.Repository,
-		Path:   w.Path,
-		Branch: w.Branch,
-		Depth:  w.depth,
-		Secret: w.Secret,
-		Auth:   w.auth,
-		cmd:    w.cmd,
-		log:    w.log,
+		URL:      w.Repository,
+		Path:     w.Path,
+		Previews: w.Previews,
+		Branch:   w.Branch,
+		Depth:    w.depth,
+		Sparse:   w.Sparse,
+		Secret:   w.secret,
+		Auth:     w.auth,
+		Backend:  w.Backend,
+		cmd:      w.cmd,
+		log:      w.log,
 	}
 
 	return r
@@ -54,137 +80,162 @@ func (r *Repo) Setup(ctx context.Context) error {
 	var err error
 	r.log.Info("setting up repository", zap.String("path", r.Path))
 
-	err = r.setRef(ctx)
+	r.backend, err = newBackend(r, r.Path)
 	if err != nil {
 		return err
 	}
 
-	r.repo, err = git.PlainOpen(r.Path)
-	if err == nil {
-		// If the path directory is a git repository, set up the remote as 'origin'
-		err = r.repo.DeleteRemote(DefaultRemote)
-		if err != nil && err != git.ErrRemoteNotFound {
-			return err
-		}
+	err = r.refreshAuth(ctx)
+	if err != nil {
+		return err
+	}
 
-		_, err = r.repo.CreateRemote(&config.RemoteConfig{
-			Name: DefaultRemote,
-			URLs: []string{r.URL},
-		})
-		if err != nil {
-			return err
-		}
+	err = r.setRef(ctx)
+	if err != nil {
+		return err
+	}
 
-		err = r.fetch(ctx)
-		if err != nil {
-			return err
-		}
+	err = r.backend.Setup(ctx, r.refName)
+	if err != nil {
+		return err
+	}
 
-		err = r.checkout(r.refName)
+	if r.LFS != nil {
+		err = r.checkoutLFS(ctx)
 		if err != nil {
 			return err
 		}
-	} else if err == git.ErrRepositoryNotExists {
-		// If the path directory is not a git repository, clone it from url.
-		r.repo, err = git.PlainCloneContext(ctx, r.Path, false, &git.CloneOptions{
-			URL:               r.URL,
-			Auth:              r.Auth,
-			RemoteName:        DefaultRemote,
-			ReferenceName:     r.refName,
-			Depth:             r.Depth,
-			RecurseSubmodules: r.Submodule,
-			Tags:              git.AllTags,
-		})
-		if err != nil {
-			return err
-		}
-	} else {
-		return err
 	}
 
 	r.log.Info("setting up repository successful")
 	if r.cmd != nil {
-		go r.cmd.Run(r.log)
+		go func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			_ = r.cmd.Run(r.log)
+		}()
 	}
 	return nil
 }
 
 // Update pulls updates from the remote repository into current worktree.
-func (r *Repo) Update(ctx context.Context) error {
-	var err error
-	if r.refName.IsBranch() {
-		err = r.pull(ctx)
-	}
+// If commit is given, the worktree is reset to it instead, unless it
+// does not follow the checked out commit. The command
+// is then run until it exits, and its error returned unless updating
+// failed.
+func (r *Repo) Update(ctx context.Context, commit string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.update(ctx, commit)
 
 	if r.cmd != nil {
-		go r.cmd.Run(r.log)
-	}
-	if err != nil {
-		return err
+		cmdErr := r.cmd.Run(r.log)
+		if cmdErr != nil && (err == nil || err == git.NoErrAlreadyUpToDate) {
+			err = cmdErr
+		}
 	}
-	return nil
+	return err
 }
 
-func (r *Repo) fetch(ctx context.Context) error {
-	if err := r.repo.FetchContext(ctx, &git.FetchOptions{
-		RemoteName: DefaultRemote,
-		Depth:      r.Depth,
-		Auth:       r.Auth,
-		Tags:       git.AllTags,
-	}); err != nil && err != git.NoErrAlreadyUpToDate {
+func (r *Repo) update(ctx context.Context, commit string) error {
+	err := r.refreshAuth(ctx)
+	if err != nil {
 		return err
 	}
-	return nil
-}
 
-func (r *Repo) pull(ctx context.Context) error {
-	worktree, err := r.repo.Worktree()
+	head, err := r.backend.Head(ctx)
 	if err != nil {
 		return err
 	}
 
-	if err := worktree.PullContext(ctx, &git.PullOptions{
-		RemoteName:    DefaultRemote,
-		ReferenceName: r.refName,
-		Depth:         r.Depth,
-		Auth:          r.Auth,
-	}); err != nil {
-		return err
+	// Events may be redelivered or handled out of order, so the
+	// worktree is never moved back to an older commit.
+	var hash plumbing.Hash
+	if commit != "" && !r.refName.IsTag() {
+		hash = plumbing.NewHash(commit)
+		if hash == head {
+			return git.NoErrAlreadyUpToDate
+		}
+
+		err = r.backend.Fetch(ctx)
+		if err != nil {
+			return err
+		}
+		follows, err := r.backend.Follows(ctx, hash, head)
+		if err != nil {
+			return err
+		}
+		if !follows {
+			return fmt.Errorf("commit %s does not follow the checked out commit %s", hash, head)
+		}
 	}
-	return nil
-}
 
-func (r *Repo) checkout(ref plumbing.ReferenceName) error {
-	worktree, err := r.repo.Worktree()
-	if err != nil {
+	if r.LFS != nil {
+		// Restore LFS pointer files, which are taken as local changes
+		// when updating.
+		err = r.backend.Checkout(ctx, r.refName, head)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case r.refName.IsTag():
+		// The hash sent for a tag may be the one of an annotated tag
+		// object, so check out the fetched tag itself.
+		err = r.backend.Fetch(ctx)
+		if err != nil {
+			return err
+		}
+		err = r.backend.Checkout(ctx, r.refName, plumbing.ZeroHash)
+	case !hash.IsZero():
+		err = r.backend.Checkout(ctx, r.refName, hash)
+	default:
+		err = r.backend.Pull(ctx, r.refName)
+	}
+	if err != nil && err != git.NoErrAlreadyUpToDate {
 		return err
 	}
 
-	if err := worktree.Checkout(&git.CheckoutOptions{Branch: ref}); err != nil {
+	if r.LFS != nil {
+		err = r.checkoutLFS(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	updated, err := r.backend.Head(ctx)
+	if err != nil {
 		return err
 	}
+	if updated == head {
+		return git.NoErrAlreadyUpToDate
+	}
+	return nil
+}
 
+// refreshAuth refreshes the credentials of the auth method before
+// accessing the remote repository, if they expire.
+func (r *Repo) refreshAuth(ctx context.Context) error {
+	if auth, ok := r.Auth.(refresher); ok {
+		return auth.Refresh(ctx)
+	}
 	return nil
 }
 
-func (r *Repo) setRef(ctx context.Context) error {
-	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
-		Name: DefaultRemote,
-		URLs: []string{r.URL},
-	})
-
-	if err := remote.FetchContext(ctx, &git.FetchOptions{
-		RemoteName: DefaultRemote,
-		Depth:      r.Depth,
-		Auth:       r.Auth,
-		Tags:       git.AllTags,
-	}); err != nil && err != git.NoErrAlreadyUpToDate {
+// checkoutLFS replaces the LFS pointer files in the worktree with
+// their objects.
+func (r *Repo) checkoutLFS(ctx context.Context) error {
+	repo, err := git.PlainOpen(r.Path)
+	if err != nil {
 		return err
 	}
+	return r.LFS.Checkout(ctx, repo, r.Path, r.Sparse)
+}
 
-	refs, err := remote.List(&git.ListOptions{
-		Auth: r.Auth,
-	})
+func (r *Repo) setRef(ctx context.Context) error {
+	refs, err := r.backend.RemoteRefs(ctx)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,65 @@
+package caddy_webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	// StatusAccepted tells the event is deployed.
+	StatusAccepted = "accepted"
+
+	// StatusIgnored tells the event is valid, but not deployed.
+	StatusIgnored = "ignored"
+
+	// StatusRejected tells the request is not a valid event.
+	StatusRejected = "rejected"
+)
+
+const (
+	// ResultSucceeded tells the deployment succeeded.
+	ResultSucceeded = "succeeded"
+
+	// ResultUpToDate tells the repository was already up-to-date,
+	// and the command succeeded.
+	ResultUpToDate = "up-to-date"
+
+	// ResultFailed tells the deployment failed.
+	ResultFailed = "failed"
+)
+
+// Response is the JSON body of the responses to webhook requests.
+type Response struct {
+	// Status is StatusAccepted, StatusIgnored or StatusRejected.
+	Status string `json:"status"`
+
+	// Reason the request is ignored or rejected, or the deployment
+	// failed.
+	Reason string `json:"reason,omitempty"`
+
+	// Event is the name of the event given by the webhook service.
+	Event string `json:"event,omitempty"`
+
+	// Job identifies the deployment of an accepted event in logs.
+	Job string `json:"job,omitempty"`
+
+	// Result of the deployment with `wait`, ResultSucceeded,
+	// ResultUpToDate or ResultFailed.
+	Result string `json:"result,omitempty"`
+}
+
+// writeResponse writes resp as the JSON response with the status code.
+func writeResponse(rw http.ResponseWriter, code int, resp *Response) error {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	return json.NewEncoder(rw).Encode(resp)
+}
+
+// newJobID returns a random ID of a deployment.
+func newJobID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
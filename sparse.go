@@ -0,0 +1,187 @@
+package caddy_webhook
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// sparseUpdate moves the reference name to commit and writes the
+// files inside the sparse directories into the worktree.
+func (g *goGit) sparseUpdate(name plumbing.ReferenceName, commit plumbing.Hash) error {
+	var head plumbing.Hash
+	if ref, err := g.repo.Head(); err == nil {
+		head = ref.Hash()
+	}
+
+	if err := g.sparseCheckout(head, commit); err != nil {
+		return err
+	}
+
+	var ref *plumbing.Reference
+	if name.IsBranch() {
+		err := g.repo.Storer.SetReference(plumbing.NewHashReference(name, commit))
+		if err != nil {
+			return err
+		}
+		ref = plumbing.NewSymbolicReference(plumbing.HEAD, name)
+	} else {
+		ref = plumbing.NewHashReference(plumbing.HEAD, commit)
+	}
+	if err := g.repo.Storer.SetReference(ref); err != nil {
+		return err
+	}
+
+	if head == commit {
+		return git.NoErrAlreadyUpToDate
+	}
+	return nil
+}
+
+// sparseCheckout writes the files of commit inside the sparse
+// directories into the worktree, and removes the files which were
+// in the previous commit but are gone.
+func (g *goGit) sparseCheckout(previous, commit plumbing.Hash) error {
+	old := map[string]plumbing.Hash{}
+	if !previous.IsZero() {
+		files, err := treeFiles(g.repo, previous, g.sparse)
+		if err != nil {
+			return err
+		}
+		for name, file := range files {
+			old[name] = file.Hash
+		}
+	}
+
+	files, err := treeFiles(g.repo, commit, g.sparse)
+	if err != nil {
+		return err
+	}
+
+	for name, file := range files {
+		path := filepath.Join(g.path, filepath.FromSlash(name))
+		if hash, ok := old[name]; ok && hash == file.Hash {
+			if _, err := os.Lstat(path); err == nil {
+				continue
+			}
+		}
+		if err := writeFile(path, file); err != nil {
+			return err
+		}
+	}
+
+	for name := range old {
+		if _, ok := files[name]; ok {
+			continue
+		}
+		path := filepath.Join(g.path, filepath.FromSlash(name))
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeFiles returns the files of commit inside dirs, or all the files
+// if dirs is empty.
+func treeFiles(repo *git.Repository, commit plumbing.Hash, dirs []string) (map[string]*object.File, error) {
+	c, err := repo.CommitObject(commit)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]*object.File{}
+	if len(dirs) == 0 {
+		err = tree.Files().ForEach(func(file *object.File) error {
+			files[file.Name] = file
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return files, nil
+	}
+
+	for _, dir := range dirs {
+		sub, err := tree.Tree(dir)
+		if err == object.ErrDirectoryNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		err = sub.Files().ForEach(func(file *object.File) error {
+			file.Name = dir + "/" + file.Name
+			files[file.Name] = file
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// writeFile writes a file from git to path.
+func writeFile(path string, file *object.File) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if file.Mode == filemode.Symlink {
+		target, err := file.Contents()
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, path)
+	}
+
+	mode, err := file.Mode.ToOSFileMode()
+	if err != nil {
+		return err
+	}
+
+	reader, err := file.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, reader); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// cleanSparse normalizes the sparse directories to slash separated
+// paths relative to the repository root.
+func cleanSparse(dirs []string) []string {
+	cleaned := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		dir = strings.Trim(filepath.ToSlash(filepath.Clean(dir)), "/")
+		if dir != "" && dir != "." {
+			cleaned = append(cleaned, dir)
+		}
+	}
+	return cleaned
+}
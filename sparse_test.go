@@ -0,0 +1,87 @@
+package caddy_webhook
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+)
+
+func TestSparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook-sparse")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	repo, err := git.PlainInit(upstream, false)
+	assert.Nil(t, err)
+	worktree, err := repo.Worktree()
+	assert.Nil(t, err)
+
+	commit := func(files map[string]string, removed ...string) {
+		for name, content := range files {
+			path := filepath.Join(upstream, name)
+			assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+			assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+			_, err := worktree.Add(name)
+			assert.Nil(t, err)
+		}
+		for _, name := range removed {
+			_, err := worktree.Remove(name)
+			assert.Nil(t, err)
+		}
+		_, err := worktree.Commit("update", &git.CommitOptions{
+			Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		})
+		assert.Nil(t, err)
+	}
+
+	commit(map[string]string{
+		"docs/index.md":     "index",
+		"docs/guide/use.md": "use",
+		"src/main.go":       "package main",
+	})
+
+	path := filepath.Join(dir, "deploy")
+	r := &Repo{
+		URL:    upstream,
+		Path:   path,
+		Branch: "master",
+		Sparse: []string{"docs"},
+		log:    zap.NewNop(),
+	}
+
+	ctx := context.Background()
+	err = r.Setup(ctx)
+	assert.Nil(t, err)
+
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(path, name))
+		return err == nil
+	}
+	assert.True(t, exists("docs/index.md"))
+	assert.True(t, exists("docs/guide/use.md"))
+	assert.False(t, exists("src/main.go"))
+
+	commit(map[string]string{
+		"docs/new.md": "new",
+		"src/lib.go":  "package main",
+	}, "docs/guide/use.md")
+
+	err = r.Update(ctx, "")
+	assert.Nil(t, err)
+	assert.True(t, exists("docs/index.md"))
+	assert.True(t, exists("docs/new.md"))
+	assert.False(t, exists("docs/guide/use.md"))
+	assert.False(t, exists("src/lib.go"))
+
+	err = r.Update(ctx, "")
+	assert.Equal(t, git.NoErrAlreadyUpToDate, err)
+}
@@ -2,24 +2,32 @@ package caddy_webhook
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/WingLim/caddy-webhook/webhooks"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 // Interface guards.
@@ -37,9 +45,28 @@ func init() {
 
 // WebHook is the module configuration.
 type WebHook struct {
-	// Git repository URL, supported http, https and ssh.
+	// Git repository URL, supported http, https and ssh. Events for
+	// other repositories are rejected. Without repository, the
+	// webhook only verifies events and runs the command.
 	Repository string `json:"repo,omitempty"`
 
+	// Full name of the repository in webhook payloads, such as
+	// `WingLim/caddy-webhook`, to match events for it when the
+	// repository is cloned from elsewhere, like a mirror.
+	// Default to the path of the repository URL.
+	RepoName string `json:"repo_name,omitempty"`
+
+	// Name of the container image events must be for, such as
+	// `winglim/caddy` or `ghcr.io/winglim/caddy`, with the registry
+	// webhook types. Default to any image.
+	Image string `json:"image,omitempty"`
+
+	// Repositories served by this handler, instead of a single one.
+	// Events are routed to the repository they are for. Each
+	// repository inherits `type`, `trigger`, `secret`, `sns_cert`,
+	// `sns_topics` and `sns_urls` if unset.
+	Repos []*WebHook `json:"repos,omitempty"`
+
 	// Path to clone and update repository.
 	Path string `json:"path,omitempty"`
 
@@ -47,30 +74,132 @@ type WebHook struct {
 	// Default to `main`.
 	Branch string `json:"branch,omitempty"`
 
-	// Webhook type.
+	// Webhook type. The registry types `dockerhub`, `harbor` and
+	// `ghcr` only run the command on image pushes, without repository.
 	// Default to `github`.
 	Type string `json:"type,omitempty"`
 
+	// Events to update the repository on, `push` or `ci`. With `ci`,
+	// pushes are ignored and the commit is checked out once CI passed
+	// on it, which is supported by github, gitlab and gitea.
+	// Default to `push`.
+	Trigger string `json:"trigger,omitempty"`
+
+	// Name or path of the GitHub Actions workflow whose successful
+	// runs are deployed with trigger `ci`, such as `test` or
+	// `.github/workflows/test.yml`. Runs of other workflows are ignored.
+	Workflow string `json:"workflow,omitempty"`
+
+	// Skip a push if the message of its head commit contains any
+	// of these markers, such as `[skip deploy]`.
+	SkipIfMessage []string `json:"skip_if_message,omitempty"`
+
+	// Only update on pushes changing any path matching these globs.
+	// `**` matches any number of directories.
+	Paths []string `json:"paths,omitempty"`
+
+	// Skip pushes which only change paths matching these globs.
+	PathsIgnore []string `json:"paths_ignore,omitempty"`
+
+	// Names of the events to handle, among those the type handles,
+	// such as `push` and `release` for github. Other events are
+	// ignored. Default to all of them.
+	Events []string `json:"events,omitempty"`
+
 	// Secret to verify webhook request.
 	Secret string `json:"secret,omitempty"`
 
+	// IPs and CIDRs webhook requests are allowed from, or names of
+	// sources of the IP ranges git services send webhooks from,
+	// `github` or `atlassian`. Default to `atlassian` for bitbucket,
+	// and any IP for other types. `off` allows any IP for bitbucket,
+	// whose requests are then verified by the secret.
+	AllowIPs []string `json:"allow_ips,omitempty"`
+
+	// URLs to fetch the IP ranges of sources from, by source name.
+	IPRangesURLs map[string]string `json:"ip_ranges_urls,omitempty"`
+
+	// IPs and CIDRs of proxies, such as load balancers, whose
+	// X-Forwarded-For header tells the IP of the client.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// Path of the PEM encoded certificate to verify the signature of
+	// Amazon SNS messages for codecommit. Default to the certificate
+	// at the signing certificate URL of each message.
+	SNSCert string `json:"sns_cert,omitempty"`
+
+	// ARNs of the SNS topics codecommit accepts messages from, which
+	// must be set for codecommit.
+	SNSTopics []string `json:"sns_topics,omitempty"`
+
+	// URLs codecommit confirms SNS subscriptions and fetches signing
+	// certificates from, each label of whose host may be a wildcard.
+	// Default to the HTTPS URLs of the hosts of Amazon SNS.
+	SNSURLs []string `json:"sns_urls,omitempty"`
+
 	// Depth for pull and fetch.
 	// Default to `0`.
 	Depth string `json:"depth,omitempty"`
 
+	// Directories to check out, instead of the whole repository.
+	// Submodules are not checked out with sparse checkout. Only the
+	// git-cli backend leaves the other files out of the download; go-git
+	// fetches every file of the commits and leaves them out of the
+	// worktree.
+	Sparse []string `json:"sparse,omitempty"`
+
+	// Download Git LFS objects of checked out files.
+	LFS bool `json:"lfs,omitempty"`
+
+	// Git LFS endpoint. Default to `<repo>.git/info/lfs`, or the
+	// endpoint told by `git-lfs-authenticate` for ssh repositories
+	// with key, key_data or ssh_agent.
+	LFSURL string `json:"lfs_url,omitempty"`
+
+	// Backend to manage the repository, `go-git` or `git-cli`. The
+	// `git-cli` backend runs the git command of the system, and uses its
+	// credential helpers and ssh configuration.
+	// Default to `go-git`.
+	Backend string `json:"backend,omitempty"`
+
 	// Enable recurse submodules.
 	Submodule bool `json:"submodule,omitempty"`
 
 	// Command to run when repo initializes or receive a
-	// correct webhook request.
+	// correct webhook request. Without repository, the event is
+	// told by the `WEBHOOK_*` environment variables.
 	Command []string `json:"command,omitempty"`
 
 	// Path of private key, using to access git with ssh.
 	Key string `json:"key,omitempty"`
 
+	// PEM encoded private key, using to access git with ssh. It can be
+	// read from placeholders, such as `{env.DEPLOY_KEY}` or
+	// `{file./run/secrets/deploy_key}`, so it needs not be a file.
+	KeyData string `json:"key_data,omitempty"`
+
 	// Password of private key.
 	KeyPassword string `json:"key_password,omitempty"`
 
+	// Access git with ssh using the keys of the ssh agent
+	// listening on `SSH_AUTH_SOCK`.
+	SSHAgent bool `json:"ssh_agent,omitempty"`
+
+	// User to access git with ssh.
+	// Default to `git`.
+	SSHUser string `json:"ssh_user,omitempty"`
+
+	// Path of known_hosts file to verify the host key of the ssh
+	// server. Default to the known_hosts files of the user.
+	KnownHosts string `json:"known_hosts,omitempty"`
+
+	// SHA256 fingerprint the host key of the ssh server must match,
+	// as printed by `ssh-keygen -l`, such as `SHA256:+DiY3wvvV6T...`.
+	HostKey string `json:"host_key,omitempty"`
+
+	// Accept any host key of the ssh server. This is insecure.
+	InsecureIgnoreHostKey bool `json:"insecure_ignore_host_key,omitempty"`
+
 	// Username for http auth.
 	Username string `json:"username,omitempty"`
 
@@ -80,6 +209,49 @@ type WebHook struct {
 	// GitHub personal access token.
 	Token string `json:"token,omitempty"`
 
+	// Authenticate as an installation of a GitHub App, instead of
+	// with a personal access token.
+	GitHubApp *GitHubApp `json:"github_app,omitempty"`
+
+	// Wait for the repository to be updated and the command to exit
+	// before responding, with the result. Requests fail with
+	// `500 Internal Server Error` if the deployment fails.
+	Wait bool `json:"wait,omitempty"`
+
+	// Pass requests which are not webhooks to the next handler, so the
+	// handler can serve a path shared with a site. Requests are
+	// webhooks if they are POST requests with the event header of
+	// the type, or of the type of any repo.
+	Passthrough bool `json:"passthrough,omitempty"`
+
+	// Maximum size of request bodies in bytes. Larger requests are
+	// rejected with `413 Request Entity Too Large`.
+	// Default to 25MB, the largest payload GitHub sends.
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+
+	// Directory to deploy pull (merge) request previews in. Each open
+	// pull request is checked out to `<previews>/pr-<number>`.
+	// Previews are disabled if empty. Each repo of a list of repos
+	// defaults to `<previews>/<name>`, with the name of the repo.
+	Previews string `json:"previews,omitempty"`
+
+	// Build previews of pull requests from forks too. The command is
+	// run on their code, so anyone who can open a pull request can run
+	// code on the server.
+	PreviewsForks bool `json:"previews_forks,omitempty"`
+
+	// Credentials with placeholders resolved, which are kept out of
+	// the configuration.
+	secret      string
+	password    string
+	token       string
+	keyPassword string
+
+	// routed is set for the webhooks of the repositories served by
+	// a handler, which verifies the IPs of requests for them.
+	routed    bool
+	allowList *AllowList
+
 	hook  webhooks.HookService
 	auth  transport.AuthMethod
 	cmd   *Cmd
@@ -88,6 +260,10 @@ type WebHook struct {
 	log   *zap.Logger
 	ctx   context.Context
 	setup bool
+
+	// mu serializes the command of a webhook without repository, as
+	// the mutex of Repo does for updates.
+	mu sync.Mutex
 }
 
 // CaddyModule returns the Caddy module information.
@@ -106,6 +282,17 @@ func (w *WebHook) Provision(ctx caddy.Context) error {
 	w.ctx = ctx.Context
 	var err error
 
+	if !w.routed {
+		err = w.provisionAllowList()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(w.Repos) > 0 {
+		return w.provisionRepos(ctx)
+	}
+
 	if w.Path == "" {
 		// If the path is empty for a repo, try to get the repo name from
 		// the Repository. If successful set it to "./<repo-name>" else
@@ -124,8 +311,26 @@ func (w *WebHook) Provision(ctx caddy.Context) error {
 		return err
 	}
 
+	if w.Previews != "" {
+		w.Previews, err = filepath.Abs(w.Previews)
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.Trigger == "" {
+		w.Trigger = webhooks.TriggerPush
+	}
+
 	w.setHookType()
 
+	if hook, ok := w.hook.(*webhooks.CodeCommit); ok && w.SNSCert != "" {
+		hook.Cert, err = loadCertificate(w.SNSCert)
+		if err != nil {
+			return fmt.Errorf("sns_cert: %v", err)
+		}
+	}
+
 	// Convert depth from string to int
 	var depth int
 	if w.Depth != "" {
@@ -138,35 +343,63 @@ func (w *WebHook) Provision(ctx caddy.Context) error {
 	}
 	w.depth = depth
 
+	w.Sparse = cleanSparse(w.Sparse)
+
+	if err := w.resolveCredentials(); err != nil {
+		return err
+	}
+
 	if w.Command != nil {
 		w.cmd = &Cmd{}
 		w.cmd.AddCommand(w.Command, w.Path)
 	}
 
+	// Without repository, the webhook only runs the command.
+	if w.Repository == "" {
+		return nil
+	}
+
 	if w.Username != "" && w.Password != "" {
 		w.auth = &githttp.BasicAuth{
 			Username: w.Username,
-			Password: w.Password,
+			Password: w.password,
 		}
 	}
 
 	if w.Token != "" {
 		w.auth = &githttp.BasicAuth{
 			Username: "git", // This can be anything.
-			Password: w.Token,
+			Password: w.token,
 		}
 	}
 
-	if w.Key != "" {
-		publicKeys, err := ssh.NewPublicKeysFromFile("git", w.Key, w.KeyPassword)
+	if w.GitHubApp != nil {
+		if err := w.GitHubApp.provision(); err != nil {
+			return fmt.Errorf("github app: %v", err)
+		}
+		w.auth = w.GitHubApp
+	}
+
+	if w.Key != "" || w.KeyData != "" || w.SSHAgent {
+		w.auth, err = w.sshAuth()
 		if err != nil {
 			return err
 		}
-		w.auth = publicKeys
 	}
 
 	w.repo = NewRepo(w)
 
+	if w.Backend == BackendGitCLI {
+		w.repo.SSHCommand = w.sshCommand()
+	}
+
+	if w.LFS {
+		w.repo.LFS, err = NewLFS(w.Repository, w.LFSURL, w.auth)
+		if err != nil {
+			return err
+		}
+	}
+
 	if w.Submodule {
 		w.repo.Submodule = git.DefaultSubmoduleRecursionDepth
 	} else {
@@ -175,20 +408,208 @@ func (w *WebHook) Provision(ctx caddy.Context) error {
 	return nil
 }
 
+// provisionAllowList sets up the IP allow list, and starts fetching
+// the IP ranges of its sources.
+func (w *WebHook) provisionAllowList() error {
+	allowIPs := w.AllowIPs
+	if len(allowIPs) == 0 && w.Type == "bitbucket" {
+		// Bitbucket webhooks are signed only if a secret is set,
+		// so they are verified by the IP ranges of Atlassian.
+		allowIPs = []string{"atlassian"}
+	}
+	if len(allowIPs) == 0 || len(allowIPs) == 1 && allowIPs[0] == "off" {
+		return nil
+	}
+
+	var err error
+	w.allowList, err = NewAllowList(allowIPs, w.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	for name, url := range w.IPRangesURLs {
+		if err := w.allowList.SetSourceURL(name, url); err != nil {
+			return err
+		}
+	}
+
+	w.allowList.CacheDir = filepath.Join(caddy.AppDataDir(), "webhook", "ip-ranges")
+	w.allowList.Start(w.ctx, w.log)
+	return nil
+}
+
+// provisionRepos sets up the webhooks of the repositories served by
+// the handler.
+func (w *WebHook) provisionRepos(ctx caddy.Context) error {
+	for _, webhook := range w.Repos {
+		if webhook.Type == "" {
+			webhook.Type = w.Type
+		}
+		if webhook.Trigger == "" {
+			webhook.Trigger = w.Trigger
+		}
+		if webhook.Workflow == "" {
+			webhook.Workflow = w.Workflow
+		}
+		if webhook.Secret == "" {
+			webhook.Secret = w.Secret
+		}
+		if webhook.SNSCert == "" {
+			webhook.SNSCert = w.SNSCert
+		}
+		if len(webhook.SNSTopics) == 0 {
+			webhook.SNSTopics = w.SNSTopics
+		}
+		if len(webhook.SNSURLs) == 0 {
+			webhook.SNSURLs = w.SNSURLs
+		}
+		if len(webhook.Events) == 0 {
+			webhook.Events = w.Events
+		}
+		if webhook.Previews == "" && w.Previews != "" {
+			name, err := getRepoNameFromURL(webhook.Repository)
+			if err != nil {
+				name = filepath.Base(webhook.Repository)
+			}
+			webhook.Previews = filepath.Join(w.Previews, name)
+		}
+		if !webhook.PreviewsForks {
+			webhook.PreviewsForks = w.PreviewsForks
+		}
+		webhook.routed = true
+
+		if err := webhook.Provision(ctx); err != nil {
+			return fmt.Errorf("repo %s: %v", webhook.Repository, err)
+		}
+	}
+	return nil
+}
+
 // Validate ensures webhook's configuration is valid.
 func (w *WebHook) Validate() error {
+	if len(w.Repos) > 0 {
+		return w.validateRepos()
+	}
+
+	if len(w.AllowIPs) == 1 && w.AllowIPs[0] == "off" && w.Type == "bitbucket" && w.Secret == "" {
+		return fmt.Errorf("cannot turn allow_ips off for bitbucket without secret")
+	}
+
+	if w.MaxBodySize < 0 {
+		return fmt.Errorf("invalid max_body_size %d", w.MaxBodySize)
+	}
+
+	if w.PreviewsForks && w.Previews == "" {
+		return fmt.Errorf("previews_forks needs previews")
+	}
+
+	if (w.Type == "git-receive" || w.Type == "sourcehut") && w.Secret == "" {
+		return fmt.Errorf("webhook type %s needs secret", w.Type)
+	}
+
+	if (w.SNSCert != "" || len(w.SNSTopics) > 0 || len(w.SNSURLs) > 0) && w.Type != "codecommit" {
+		return fmt.Errorf("sns_cert, sns_topics and sns_urls are only supported by webhook type codecommit")
+	}
+
+	if w.Type == "codecommit" && len(w.SNSTopics) == 0 {
+		return fmt.Errorf("webhook type codecommit needs sns_topics")
+	}
+
+	if len(w.Events) > 0 && (w.Type == "codecommit" || w.Type == "dockerhub" || w.Type == "git-receive") {
+		return fmt.Errorf("events is not supported by webhook type %s", w.Type)
+	}
+	for _, event := range w.Events {
+		if !typeEvents[w.Type][event] {
+			return fmt.Errorf("unknown event %q of webhook type %q", event, w.Type)
+		}
+	}
+
+	switch w.Trigger {
+	case webhooks.TriggerPush:
+	case webhooks.TriggerCI:
+		switch w.Type {
+		case "", "github", "gitlab", "gitea":
+		default:
+			return fmt.Errorf("trigger %q is not supported by webhook type %q", w.Trigger, w.Type)
+		}
+		// The commit to check out is told by the event.
+		if w.Secret == "" {
+			return fmt.Errorf("trigger %q needs secret", w.Trigger)
+		}
+		// The combined status is got from the host of the repository.
+		if w.Type == "gitea" && giteaAPIURL(w.Repository) == "" {
+			return fmt.Errorf("trigger %q of webhook type gitea needs repo with http or ssh url", w.Trigger)
+		}
+		// Any workflow passing, such as lint, would deploy the commit.
+		if (w.Type == "" || w.Type == "github") && w.Workflow == "" {
+			return fmt.Errorf("trigger %q of webhook type github needs workflow", w.Trigger)
+		}
+	default:
+		return fmt.Errorf("unknown trigger %q", w.Trigger)
+	}
+
+	if w.Workflow != "" && (w.Trigger != webhooks.TriggerCI || (w.Type != "" && w.Type != "github")) {
+		return fmt.Errorf("workflow is only supported by trigger %q of webhook type github", webhooks.TriggerCI)
+	}
+
+	if w.Image != "" && !registryTypes[w.Type] {
+		return fmt.Errorf("image is only supported by registry webhook types")
+	}
+
 	if w.Repository == "" {
-		return fmt.Errorf("cannot create repository with empty URL")
+		return w.validateCommandOnly()
+	}
+
+	if registryTypes[w.Type] {
+		return fmt.Errorf("webhook type %s runs command without repo", w.Type)
 	}
 
 	if w.Path == "" {
 		return fmt.Errorf("cannot create repository in empty path")
 	}
 
-	if w.Key != "" && w.auth.Name() != ssh.PublicKeysName {
+	if w.InsecureIgnoreHostKey && (w.KnownHosts != "" || w.HostKey != "") {
+		return fmt.Errorf("cannot verify host key with insecure_ignore_host_key")
+	}
+
+	switch w.Backend {
+	case "", BackendGoGit:
+		if w.Key == "" && w.KeyData == "" && !w.SSHAgent &&
+			(w.KnownHosts != "" || w.HostKey != "" || w.InsecureIgnoreHostKey) {
+			return fmt.Errorf("cannot verify host key without key, key_data or ssh_agent")
+		}
+	case BackendGitCLI:
+		if w.KeyPassword != "" {
+			return fmt.Errorf("key password is not supported by backend %q", w.Backend)
+		}
+		if w.KeyData != "" {
+			return fmt.Errorf("key data is not supported by backend %q, use key or ssh_agent", w.Backend)
+		}
+		if w.HostKey != "" {
+			return fmt.Errorf("host key is not supported by backend %q, use known_hosts", w.Backend)
+		}
+	default:
+		return fmt.Errorf("unknown backend %q", w.Backend)
+	}
+
+	var sshAuths int
+	for _, set := range []bool{w.Key != "", w.KeyData != "", w.SSHAgent} {
+		if set {
+			sshAuths++
+		}
+	}
+	if sshAuths > 1 {
+		return fmt.Errorf("only one of key, key_data and ssh_agent can be used")
+	}
+
+	if (w.Key != "" || w.KeyData != "") && w.auth.Name() != ssh.PublicKeysName {
 		return fmt.Errorf("wrong auth method with public key")
 	}
 
+	if w.SSHAgent && w.auth.Name() != ssh.PublicKeysCallbackName {
+		return fmt.Errorf("wrong auth method with ssh agent")
+	}
+
 	if w.Username != "" && w.Password != "" && w.auth.Name() != "http-basic-auth" {
 		return fmt.Errorf("wrong auth method with username and password")
 	}
@@ -197,6 +618,21 @@ func (w *WebHook) Validate() error {
 		return fmt.Errorf("wrong auth method with token")
 	}
 
+	if w.GitHubApp != nil {
+		if w.GitHubApp.AppID == 0 || w.GitHubApp.InstallationID == 0 {
+			return fmt.Errorf("github app needs app_id and installation_id")
+		}
+		if w.auth.Name() != githubAppAuthName {
+			return fmt.Errorf("wrong auth method with github app")
+		}
+	}
+
+	for _, dir := range w.Sparse {
+		if dir == ".." || strings.HasPrefix(dir, "../") {
+			return fmt.Errorf("sparse directory %q is outside of repository", dir)
+		}
+	}
+
 	if !isEmptyOrGit(w.Path, w.log) {
 		return fmt.Errorf("given path is neither empty nor git repository")
 	}
@@ -215,49 +651,447 @@ func (w *WebHook) Validate() error {
 	return nil
 }
 
+// validateCommandOnly ensures the webhook without repository, which
+// only runs the command, is valid.
+func (w *WebHook) validateCommandOnly() error {
+	if w.Command == nil {
+		return fmt.Errorf("webhook without repo needs command")
+	}
+
+	if w.Previews != "" || w.PreviewsForks || len(w.Sparse) > 0 || w.LFS || w.Submodule || w.Depth != "" {
+		return fmt.Errorf("previews, previews_forks, sparse, lfs, submodule and depth need repo")
+	}
+	return nil
+}
+
+// validateRepos ensures the webhooks of the repositories served by
+// the handler are valid.
+func (w *WebHook) validateRepos() error {
+	if w.Repository != "" {
+		return fmt.Errorf("cannot use repo with a list of repos")
+	}
+
+	paths := make(map[string]bool)
+	previews := make(map[string]bool)
+	for _, webhook := range w.Repos {
+		if len(webhook.Repos) > 0 {
+			return fmt.Errorf("repo %s: repos cannot be nested", webhook.Repository)
+		}
+		if len(webhook.AllowIPs) > 0 || len(webhook.TrustedProxies) > 0 {
+			return fmt.Errorf("repo %s: allow_ips and trusted_proxies apply to all repos", webhook.Repository)
+		}
+		if webhook.Passthrough || webhook.MaxBodySize != 0 {
+			return fmt.Errorf("repo %s: passthrough and max_body_size apply to all repos", webhook.Repository)
+		}
+		if webhook.Type == "bitbucket" && webhook.Secret == "" && w.allowList == nil {
+			return fmt.Errorf("repo %s: bitbucket needs secret or allow_ips", webhook.Repository)
+		}
+		if paths[webhook.Path] {
+			return fmt.Errorf("repo %s: path %s is used by another repo", webhook.Repository, webhook.Path)
+		}
+		paths[webhook.Path] = true
+		if webhook.Previews != "" {
+			if previews[webhook.Previews] {
+				return fmt.Errorf("repo %s: previews %s is used by another repo", webhook.Repository, webhook.Previews)
+			}
+			previews[webhook.Previews] = true
+		}
+	}
+
+	for _, webhook := range w.Repos {
+		if err := webhook.Validate(); err != nil {
+			return fmt.Errorf("repo %s: %v", webhook.Repository, err)
+		}
+	}
+	return nil
+}
+
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (w *WebHook) ServeHTTP(rw http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	if !w.setup {
-		return caddyhttp.Error(
-			http.StatusNotFound,
-			fmt.Errorf("page not found"),
-		)
+	if w.Passthrough && !w.isWebhook(r) {
+		w.setPreviewPlaceholders(r)
+		return next.ServeHTTP(rw, r)
 	}
 
 	if err := ValidateRequest(r); err != nil {
-		return err
+		return w.reject(rw, http.StatusMethodNotAllowed, err)
 	}
 
+	if w.allowList != nil {
+		if err := w.allowList.Verify(r); err != nil {
+			return w.reject(rw, http.StatusForbidden, err)
+		}
+	}
+
+	body, code, err := w.readBody(r)
+	if err != nil {
+		return w.reject(rw, code, err)
+	}
+
+	webhook, event, code, err := w.handle(r, body)
+	if err != nil && code < http.StatusMultipleChoices {
+		return w.ignore(rw, code, err)
+	}
+	if err != nil {
+		return w.reject(rw, code, err)
+	}
+
+	if event.Ping {
+		webhook.log.Info("ping received", zap.String("event", event.Name))
+		return writeResponse(rw, http.StatusOK, &Response{
+			Status: StatusIgnored,
+			Reason: "ping",
+			Event:  event.Name,
+		})
+	}
+
+	// Valid events wait for the repository they are for to be set up,
+	// after the provider verified the request.
+	if webhook.repo != nil && !webhook.setup {
+		return w.reject(rw, http.StatusNotFound, fmt.Errorf("repository %s not setup", webhook.Repository))
+	}
+
+	resp := &Response{
+		Status: StatusAccepted,
+		Event:  event.Name,
+		Job:    newJobID(),
+	}
+	log := webhook.log.With(zap.String("job", resp.Job))
+
+	if !w.Wait && !webhook.Wait {
+		go webhook.deploy(event, log)
+		return writeResponse(rw, http.StatusOK, resp)
+	}
+
+	code = http.StatusOK
+	err = webhook.deploy(event, log)
+	switch {
+	case err == nil:
+		resp.Result = ResultSucceeded
+	case err == git.NoErrAlreadyUpToDate:
+		resp.Result = ResultUpToDate
+	default:
+		code = http.StatusInternalServerError
+		resp.Result = ResultFailed
+		resp.Reason = err.Error()
+	}
+	return writeResponse(rw, code, resp)
+}
+
+// isWebhook reports whether the request is a POST request with the
+// event header of the type of w, or of any of its repositories.
+// Requests for types without event header only need to be POST.
+func (w *WebHook) isWebhook(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+	if len(w.Repos) == 0 {
+		return hasEventHeader(r, w.Type)
+	}
+	for _, webhook := range w.Repos {
+		if hasEventHeader(r, webhook.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasEventHeader reports whether the request has the event header of
+// the webhook type, if the type has one.
+func hasEventHeader(r *http.Request, typ string) bool {
+	header, ok := eventHeaders[typ]
+	return !ok || r.Header.Get(header) != ""
+}
+
+// eventHeaders are the headers telling the event of the webhook types
+// which have one.
+var eventHeaders = map[string]string{
+	"":                 "X-Github-Event",
+	"github":           "X-Github-Event",
+	"gitlab":           "X-Gitlab-Event",
+	"gitee":            "X-Gitee-Event",
+	"bitbucket":        "X-Event-Key",
+	"bitbucket-server": "X-Event-Key",
+	"gogs":             "X-Gogs-Event",
+	"gitea":            "X-Gogs-Event",
+	"codecommit":       "X-Amz-Sns-Message-Type",
+	"sourcehut":        "X-Webhook-Event",
+	"ghcr":             "X-Github-Event",
+}
+
+// typeEvents are the names of the events each webhook type handles,
+// which events may select.
+var typeEvents = map[string]map[string]bool{
+	"":                 {"ping": true, "push": true, "release": true, "workflow_run": true, "pull_request": true},
+	"github":           {"ping": true, "push": true, "release": true, "workflow_run": true, "pull_request": true},
+	"gitlab":           {"Push Hook": true, "Tag Push Hook": true, "Pipeline Hook": true, "Merge Request Hook": true},
+	"gitee":            {"Push Hook": true, "Tag Push Hook": true},
+	"bitbucket":        {"repo:push": true},
+	"bitbucket-server": {"diagnostics:ping": true, "repo:refs_changed": true},
+	"gogs":             {"push": true, "create": true, "status": true, "pull_request": true},
+	"gitea":            {"push": true, "create": true, "status": true, "pull_request": true},
+	"azure":            {"git.push": true},
+	"sourcehut":        {"repo:post-update": true},
+	"harbor":           {"PUSH_ARTIFACT": true},
+	"ghcr":             {"ping": true, "package": true, "registry_package": true},
+}
+
+// ignore logs why a valid event is not deployed, and responds with it.
+func (w *WebHook) ignore(rw http.ResponseWriter, code int, err error) error {
+	w.log.Info("event ignored", zap.String("reason", err.Error()))
+	return writeResponse(rw, code, &Response{
+		Status: StatusIgnored,
+		Reason: err.Error(),
+	})
+}
+
+// reject logs the error of a rejected request, and responds with it.
+func (w *WebHook) reject(rw http.ResponseWriter, code int, err error) error {
+	w.log.Warn(err.Error())
+	return writeResponse(rw, code, &Response{
+		Status: StatusRejected,
+		Reason: err.Error(),
+	})
+}
+
+// deploy updates the repository or deploys the preview the event asks
+// for, or runs the command of a webhook without repository.
+func (w *WebHook) deploy(event *webhooks.Event, log *zap.Logger) error {
+	if event.PullRequest != nil {
+		return w.deployPreview(event.PullRequest, log)
+	}
+
+	if w.repo == nil {
+		return w.runCommand(event, log)
+	}
+
+	log.Info("updating repository", zap.String("path", w.Path))
+
+	err := w.repo.Update(w.ctx, event.Commit)
+	if err == git.NoErrAlreadyUpToDate {
+		log.Info("already up-to-date", zap.String("path", w.Path))
+	} else if err != nil {
+		log.Error(
+			"cannot update repository",
+			zap.Error(err),
+			zap.String("path", w.Path),
+		)
+	}
+	return err
+}
+
+// defaultMaxBodySize is the default maximum size of request bodies.
+const defaultMaxBodySize = 25 << 20
+
+// readBody reads the body of the request, which is rejected if it is
+// larger than the maximum size, before reading it if its length is
+// told.
+func (w *WebHook) readBody(r *http.Request) ([]byte, int, error) {
+	max := w.MaxBodySize
+	if max == 0 {
+		max = defaultMaxBodySize
+	}
+
+	if r.ContentLength > max {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("body of %d bytes larger than %d bytes", r.ContentLength, max)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if int64(len(body)) > max {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("body larger than %d bytes", max)
+	}
+	return body, http.StatusOK, nil
+}
+
+// handle handles the webhook request, and returns the webhook of the
+// repository the event is for.
+func (w *WebHook) handle(r *http.Request, body []byte) (*WebHook, *webhooks.Event, int, error) {
+	if len(w.Repos) == 0 {
+		event, code, err := w.hook.Handle(r, body, w.hookConf())
+		return w, event, code, err
+	}
+
+	for _, webhook := range w.Repos {
+		event, code, err := webhook.hook.Handle(r, body, webhook.hookConf())
+		if errors.Is(err, webhooks.ErrRepositoryMismatch) {
+			continue
+		}
+		return webhook, event, code, err
+	}
+
+	return w, nil, http.StatusBadRequest, fmt.Errorf("%w: no repo for the event", webhooks.ErrRepositoryMismatch)
+}
+
+// hookConf returns the configuration of the hook service.
+func (w *WebHook) hookConf() *webhooks.HookConf {
 	hc := &webhooks.HookConf{
-		Secret:  w.Secret,
-		RefName: w.repo.refName,
+		Secret:        w.secret,
+		Repository:    w.repoID(),
+		Trigger:       w.Trigger,
+		Workflow:      w.Workflow,
+		Token:         w.token,
+		SkipIfMessage: w.SkipIfMessage,
+		Paths:         w.Paths,
+		PathsIgnore:   w.PathsIgnore,
+		Previews:      w.Previews != "",
+		PreviewForks:  w.PreviewsForks,
+		Events:        w.Events,
+	}
+	hc.RefName = w.refName()
+	return hc
+}
+
+// refName returns the ref events must be for, which is resolved when
+// the repository is set up, or the branch without repository.
+func (w *WebHook) refName() plumbing.ReferenceName {
+	if w.repo != nil {
+		return w.repo.refName
 	}
 
-	code, err := w.hook.Handle(r, hc)
+	switch {
+	case w.Branch == "":
+		return plumbing.NewBranchReferenceName(DefaultBranch)
+	case strings.HasPrefix(w.Branch, "refs/"):
+		return plumbing.ReferenceName(w.Branch)
+	default:
+		return plumbing.NewBranchReferenceName(w.Branch)
+	}
+}
+
+// repoID returns the full name or URL identifying the repository in
+// webhook payloads.
+func (w *WebHook) repoID() string {
+	if w.RepoName != "" {
+		return w.RepoName
+	}
+	if w.Image != "" {
+		return w.Image
+	}
+	return w.Repository
+}
+
+// setPreviewPlaceholders sets the `{webhook.preview.path}` and
+// `{webhook.preview.number}` placeholders for requests to the host of a
+// preview, `pr-<number>.<domain>`, so the next handlers can serve it.
+// With a list of repos, the host is `pr-<number>.<repo>.<domain>`,
+// where repo is the name of the previews directory of the repo.
+func (w *WebHook) setPreviewPlaceholders(r *http.Request) {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.Host)
 	if err != nil {
-		rw.WriteHeader(code)
-		w.log.Warn(err.Error())
-		return caddyhttp.Error(code, err)
+		host = r.Host
+	}
+	labels := strings.Split(host, ".")
+	number, err := strconv.Atoi(strings.TrimPrefix(labels[0], "pr-"))
+	if !strings.HasPrefix(labels[0], "pr-") || err != nil || number <= 0 {
+		return
 	}
 
-	go func(webhook *WebHook) {
-		webhook.log.Info("updating repository", zap.String("path", webhook.Path))
-
-		if err := webhook.repo.Update(webhook.ctx); err != nil {
-			if err == git.NoErrAlreadyUpToDate {
-				webhook.log.Info("already up-to-date", zap.String("path", webhook.Path))
-			} else {
-				webhook.log.Error(
-					"cannot update repository",
-					zap.Error(err),
-					zap.String("path", webhook.Path),
-				)
+	webhook := w
+	if len(w.Repos) > 0 {
+		webhook = nil
+		for _, repo := range w.Repos {
+			if len(labels) > 1 && repo.Previews != "" && filepath.Base(repo.Previews) == labels[1] {
+				webhook = repo
+				break
 			}
-			return
 		}
-	}(w)
+	}
+	if webhook == nil || webhook.repo == nil || webhook.Previews == "" {
+		return
+	}
 
-	return nil
+	repl.Set("webhook.preview.path", webhook.repo.PreviewPath(number))
+	repl.Set("webhook.preview.number", number)
+}
+
+// deployPreview deploys the preview of the pull request, or removes it
+// if the pull request is closed.
+func (w *WebHook) deployPreview(pr *webhooks.PullRequest, log *zap.Logger) error {
+	path := w.repo.PreviewPath(pr.Number)
+
+	if pr.Closed {
+		log.Info("removing preview", zap.String("path", path))
+
+		err := w.repo.RemovePreview(pr.Number)
+		if err != nil {
+			log.Error(
+				"cannot remove preview",
+				zap.Error(err),
+				zap.String("path", path),
+			)
+		}
+		return err
+	}
+
+	log.Info("deploying preview", zap.String("path", path))
+
+	err := w.repo.Preview(w.ctx, pr)
+	if err != nil {
+		log.Error(
+			"cannot deploy preview",
+			zap.Error(err),
+			zap.String("path", path),
+		)
+	}
+	return err
+}
+
+// runCommand runs the command of a webhook without repository, with
+// the event in environment variables.
+func (w *WebHook) runCommand(event *webhooks.Event, log *zap.Logger) error {
+	if w.cmd == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	cmd := *w.cmd
+	cmd.Env = w.eventEnv(event)
+	return cmd.Run(log)
+}
+
+// eventEnv returns the environment variables telling the event to
+// the command.
+func (w *WebHook) eventEnv(event *webhooks.Event) []string {
+	env := []string{"WEBHOOK_EVENT=" + event.Name}
+	if event.Image != nil {
+		env = append(env,
+			"WEBHOOK_IMAGE="+event.Image.Name,
+			"WEBHOOK_IMAGE_TAG="+event.Image.Tag,
+			"WEBHOOK_IMAGE_DIGEST="+event.Image.Digest,
+		)
+	} else {
+		ref := event.Ref
+		if ref == "" {
+			ref = w.refName().String()
+		}
+		commit := event.Commit
+		if commit == "" {
+			commit = event.Head
+		}
+		env = append(env,
+			"WEBHOOK_REF="+ref,
+			"WEBHOOK_COMMIT="+commit,
+		)
+	}
+	return env
+}
+
+// registryTypes are the webhook types of container registries, which
+// run the command without repository.
+var registryTypes = map[string]bool{
+	"dockerhub": true,
+	"harbor":    true,
+	"ghcr":      true,
 }
 
 // setHookType set the type which hook service we will use.
@@ -269,8 +1103,24 @@ func (w *WebHook) setHookType() {
 		w.hook = webhooks.Gitlab{}
 	case "bitbucket":
 		w.hook = webhooks.Bitbucket{}
-	case "gogs":
-		w.hook = webhooks.Gogs{}
+	case "bitbucket-server":
+		w.hook = webhooks.BitbucketServer{}
+	case "gogs", "gitea":
+		w.hook = webhooks.Gogs{APIURL: giteaAPIURL(w.Repository)}
+	case "azure":
+		w.hook = webhooks.Azure{}
+	case "codecommit":
+		w.hook = &webhooks.CodeCommit{Topics: w.SNSTopics, URLs: w.SNSURLs}
+	case "git-receive":
+		w.hook = &webhooks.GitReceive{}
+	case "sourcehut":
+		w.hook = &webhooks.Sourcehut{}
+	case "dockerhub":
+		w.hook = webhooks.DockerHub{}
+	case "harbor":
+		w.hook = webhooks.Harbor{}
+	case "ghcr":
+		w.hook = webhooks.GHCR{}
 	default:
 		w.hook = webhooks.Github{}
 	}
@@ -286,6 +1136,190 @@ func ValidateRequest(r *http.Request) error {
 	return nil
 }
 
+// resolveCredentials resolves the placeholders of the credentials,
+// such as `{env.WEBHOOK_SECRET}` or `{file./run/secrets/token}`.
+func (w *WebHook) resolveCredentials() error {
+	for _, c := range []struct {
+		name  string
+		value string
+		dst   *string
+	}{
+		{"secret", w.Secret, &w.secret},
+		{"password", w.Password, &w.password},
+		{"token", w.Token, &w.token},
+		{"key_password", w.KeyPassword, &w.keyPassword},
+	} {
+		if c.value == "" {
+			continue
+		}
+
+		value, err := resolveCredential(c.value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", c.name, err)
+		}
+		*c.dst = value
+	}
+	return nil
+}
+
+// sshAuth creates the ssh auth method from the key file, the key data
+// or the ssh agent.
+func (w *WebHook) sshAuth() (transport.AuthMethod, error) {
+	user := w.SSHUser
+	if user == "" {
+		user = ssh.DefaultUsername
+	}
+
+	var callback gossh.HostKeyCallback
+	if w.InsecureIgnoreHostKey {
+		callback = gossh.InsecureIgnoreHostKey()
+	} else if w.KnownHosts != "" || w.HostKey != "" {
+		var err error
+		callback, err = newHostKeyCallback(w.KnownHosts, w.HostKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if w.SSHAgent {
+		auth, err := ssh.NewSSHAgentAuth(user)
+		if err != nil {
+			return nil, err
+		}
+		auth.HostKeyCallback = callback
+		return auth, nil
+	}
+
+	var auth *ssh.PublicKeys
+	var err error
+	if w.KeyData != "" {
+		var pem string
+		pem, err = resolveCredential(w.KeyData)
+		if err != nil {
+			return nil, err
+		}
+		auth, err = ssh.NewPublicKeys(user, []byte(pem), w.keyPassword)
+	} else {
+		auth, err = ssh.NewPublicKeysFromFile(user, w.Key, w.keyPassword)
+	}
+	if err != nil {
+		return nil, err
+	}
+	auth.HostKeyCallback = callback
+	return auth, nil
+}
+
+// resolveCredential resolves the credential if it is a placeholder,
+// such as `{env.WEBHOOK_SECRET}`, or returns it as is, so literal
+// credentials may contain braces.
+func resolveCredential(value string) (string, error) {
+	inner := strings.TrimSuffix(strings.TrimPrefix(value, "{"), "}")
+	if len(inner) != len(value)-2 || inner == "" || strings.ContainsAny(inner, "{}") {
+		return value, nil
+	}
+	return newReplacer().ReplaceOrErr(value, true, true)
+}
+
+// newReplacer creates the replacer for placeholders in the
+// configuration, with `{file.*}` replaced by the content of the file.
+func newReplacer() *caddy.Replacer {
+	repl := caddy.NewReplacer()
+	repl.Map(func(key string) (interface{}, bool) {
+		const filePrefix = "file."
+		if !strings.HasPrefix(key, filePrefix) {
+			return nil, false
+		}
+
+		content, err := ioutil.ReadFile(key[len(filePrefix):])
+		if err != nil {
+			return nil, false
+		}
+		return strings.TrimSuffix(string(content), "\n"), true
+	})
+	return repl
+}
+
+// sshCommand returns the ssh command for the git-cli backend, or
+// empty to use the default.
+func (w *WebHook) sshCommand() string {
+	args := []string{"ssh"}
+
+	if w.Key != "" {
+		args = append(args, "-i", shellQuote(w.Key), "-o", "IdentitiesOnly=yes")
+	}
+
+	if w.SSHUser != "" {
+		args = append(args, "-l", shellQuote(w.SSHUser))
+	}
+
+	if w.InsecureIgnoreHostKey {
+		args = append(args, "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null")
+	} else if w.KnownHosts != "" {
+		args = append(args, "-o", "StrictHostKeyChecking=yes", "-o", shellQuote("UserKnownHostsFile="+w.KnownHosts))
+	}
+
+	if len(args) == 1 {
+		return ""
+	}
+	return strings.Join(args, " ")
+}
+
+// loadCertificate loads the PEM encoded certificate at path.
+func loadCertificate(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate in %s", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// shellQuote quotes s as a single shell word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// giteaAPIURL returns the Gitea API URL of the repository at repoURL,
+// such as `https://gitea.example.com/api/v1/repos/owner/name`, or empty
+// if it cannot be derived. Gitea may be served under a sub path for
+// http URLs, and at the root of the host for ssh URLs.
+func giteaAPIURL(repoURL string) string {
+	var base *url.URL
+	var path string
+	if strings.HasPrefix(repoURL, "http://") || strings.HasPrefix(repoURL, "https://") {
+		u, err := url.Parse(repoURL)
+		if err != nil {
+			return ""
+		}
+		base = &url.URL{Scheme: u.Scheme, Host: u.Host}
+		path = u.Path
+	} else {
+		addr, p := lfsSSHRemote(repoURL)
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return ""
+		}
+		base = &url.URL{Scheme: "https", Host: host}
+		path = p
+	}
+
+	parts := strings.Split(strings.TrimSuffix(strings.Trim(path, "/"), ".git"), "/")
+	if len(parts) < 2 || parts[len(parts)-2] == "" || parts[len(parts)-1] == "" {
+		return ""
+	}
+	n := len(parts)
+	prefix := strings.Join(parts[:n-2], "/")
+	if prefix != "" {
+		prefix = "/" + prefix
+	}
+	base.Path = prefix + "/api/v1/repos/" + parts[n-2] + "/" + parts[n-1]
+	return base.String()
+}
+
 // getRepoNameFromURL extracts the repo name from the HTTP URL of the repo.
 func getRepoNameFromURL(u string) (string, error) {
 	var name string
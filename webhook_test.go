@@ -1,12 +1,40 @@
 package caddy_webhook
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/WingLim/caddy-webhook/webhooks"
 	"github.com/alecthomas/assert"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"go.uber.org/zap"
 )
 
 func TestGetRepoNameFromURL(t *testing.T) {
@@ -82,3 +110,668 @@ func TestIsEmptyOrGit(t *testing.T) {
 		assert.Equal(t, tc.expected, actual, fmt.Sprintf("case %d", i))
 	}
 }
+
+func TestSSHAuthKeyData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook-key")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	data := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+
+	file := filepath.Join(dir, "deploy_key")
+	assert.Nil(t, ioutil.WriteFile(file, []byte(data), 0600))
+	assert.Nil(t, os.Setenv("WEBHOOK_TEST_DEPLOY_KEY", data))
+	defer os.Unsetenv("WEBHOOK_TEST_DEPLOY_KEY")
+
+	for i, tc := range []struct {
+		keyData string
+		user    string
+		err     bool
+	}{
+		{data, "", false},
+		{"{env.WEBHOOK_TEST_DEPLOY_KEY}", "deploy", false},
+		{"{file." + file + "}", "", false},
+		{"{env.WEBHOOK_TEST_NOT_EXIST}", "", true},
+		{"not a key", "", true},
+	} {
+		w := &WebHook{KeyData: tc.keyData, SSHUser: tc.user}
+		auth, err := w.sshAuth()
+
+		assert.Equal(t, tc.err, err != nil, fmt.Sprintf("case %d", i))
+		if !tc.err {
+			user := tc.user
+			if user == "" {
+				user = ssh.DefaultUsername
+			}
+			assert.Equal(t, user, auth.(*ssh.PublicKeys).User, fmt.Sprintf("case %d", i))
+		}
+	}
+}
+
+func TestResolveCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook-credentials")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "token")
+	assert.Nil(t, ioutil.WriteFile(file, []byte("file-token\n"), 0600))
+	assert.Nil(t, os.Setenv("WEBHOOK_TEST_SECRET", "env-secret"))
+	defer os.Unsetenv("WEBHOOK_TEST_SECRET")
+
+	w := &WebHook{
+		Secret:   "{env.WEBHOOK_TEST_SECRET}",
+		Password: "literal",
+		Token:    "{file." + file + "}",
+	}
+	assert.Nil(t, w.resolveCredentials())
+	assert.Equal(t, "env-secret", w.secret)
+	assert.Equal(t, "literal", w.password)
+	assert.Equal(t, "file-token", w.token)
+	assert.Equal(t, "", w.keyPassword)
+
+	// Resolved credentials are not in the config.
+	config, err := json.Marshal(w)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(config), "env-secret")
+	assert.NotContains(t, string(config), "file-token")
+
+	// Literal credentials are in the config as given.
+	assert.Contains(t, string(config), `"password":"literal"`)
+
+	// Literal credentials may contain braces.
+	w = &WebHook{
+		Secret:   "s3cr{e}t",
+		Password: "{password",
+		Token:    "{a}{b}",
+	}
+	assert.Nil(t, w.resolveCredentials())
+	assert.Equal(t, "s3cr{e}t", w.secret)
+	assert.Equal(t, "{password", w.password)
+	assert.Equal(t, "{a}{b}", w.token)
+
+	w = &WebHook{Secret: "{env.WEBHOOK_TEST_NOT_EXIST}"}
+	assert.NotNil(t, w.resolveCredentials())
+}
+
+func TestRouteRepos(t *testing.T) {
+	newWebHook := func(repo, name string) *WebHook {
+		return &WebHook{
+			Repository: repo,
+			RepoName:   name,
+			hook:       webhooks.Github{},
+			repo:       &Repo{refName: plumbing.NewBranchReferenceName("main")},
+			log:        zap.NewNop(),
+			setup:      true,
+		}
+	}
+
+	site := newWebHook("https://github.com/WingLim/site.git", "")
+	blog := newWebHook("git@github.com:WingLim/blog.git", "")
+	mirror := newWebHook("https://mirror.example.com/docs.git", "WingLim/docs")
+	w := &WebHook{
+		Repos: []*WebHook{site, blog, mirror},
+		log:   zap.NewNop(),
+	}
+
+	for i, tc := range []struct {
+		fullName string
+		webhook  *WebHook
+	}{
+		{"WingLim/site", site},
+		{"WingLim/blog", blog},
+		{"WingLim/docs", mirror},
+		{"WingLim/other", nil},
+	} {
+		body := fmt.Sprintf(`{"ref": "refs/heads/main", "repository": {"full_name": %q}}`, tc.fullName)
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBufferString(body))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.Header.Add("X-Github-Event", "push")
+
+		webhook, _, code, err := w.handle(req, []byte(body))
+		if tc.webhook == nil {
+			assert.True(t, errors.Is(err, webhooks.ErrRepositoryMismatch), fmt.Sprintf("case %d", i))
+			assert.Equal(t, http.StatusBadRequest, code, fmt.Sprintf("case %d", i))
+			continue
+		}
+
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		assert.Equal(t, http.StatusOK, code, fmt.Sprintf("case %d", i))
+		assert.Equal(t, tc.webhook, webhook, fmt.Sprintf("case %d", i))
+	}
+
+	assert.Equal(t, "https://github.com/WingLim/site.git", site.hookConf().Repository)
+	assert.Equal(t, "WingLim/docs", mirror.hookConf().Repository)
+}
+
+func TestRegistryCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook-registry")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "image")
+	w := &WebHook{
+		Type:    "dockerhub",
+		Image:   "winglim/caddy",
+		Trigger: webhooks.TriggerPush,
+		Command: []string{"sh", "-c", `echo "$WEBHOOK_IMAGE:$WEBHOOK_IMAGE_TAG" > image`},
+		hook:    webhooks.DockerHub{},
+		log:     zap.NewNop(),
+	}
+	w.cmd = &Cmd{}
+	w.cmd.AddCommand(w.Command, dir)
+	assert.Nil(t, w.Validate())
+
+	body := `{"push_data": {"tag": "latest"}, "repository": {"repo_name": "winglim/caddy"}}`
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewBufferString(body))
+	assert.Nil(t, err)
+	rec := httptest.NewRecorder()
+	assert.Nil(t, w.ServeHTTP(rec, req, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var data []byte
+	for i := 0; i < 100; i++ {
+		if data, err = ioutil.ReadFile(out); err == nil && len(data) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "winglim/caddy:latest\n", string(data))
+
+	for i, tc := range []*WebHook{
+		{Type: "dockerhub", Trigger: webhooks.TriggerPush},
+		{Type: "dockerhub", Trigger: webhooks.TriggerPush, Repository: "https://github.com/WingLim/caddy.git", Command: []string{"true"}},
+		{Type: "github", Trigger: webhooks.TriggerPush, Image: "winglim/caddy", Repository: "https://github.com/WingLim/caddy.git"},
+	} {
+		assert.NotNil(t, tc.Validate(), fmt.Sprintf("case %d", i))
+	}
+}
+
+func TestCommandOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook-command")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "event")
+	w := &WebHook{
+		RepoName: "WingLim/site",
+		Branch:   "deploy",
+		Trigger:  webhooks.TriggerPush,
+		Command:  []string{"sh", "-c", `echo "$WEBHOOK_EVENT $WEBHOOK_REF $WEBHOOK_COMMIT" > event`},
+		hook:     webhooks.Github{},
+		log:      zap.NewNop(),
+	}
+	w.cmd = &Cmd{}
+	w.cmd.AddCommand(w.Command, dir)
+	assert.Nil(t, w.Validate())
+
+	for i, tc := range []struct {
+		ref      string
+		fullName string
+		code     int
+	}{
+		{"refs/heads/main", "WingLim/site", http.StatusAccepted},
+		{"refs/heads/deploy", "WingLim/other", http.StatusBadRequest},
+		{"refs/heads/deploy", "WingLim/site", http.StatusOK},
+	} {
+		body := fmt.Sprintf(`{"ref": %q, "repository": {"full_name": %q}}`, tc.ref, tc.fullName)
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBufferString(body))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.Header.Add("X-Github-Event", "push")
+
+		_, _, code, _ := w.handle(req, []byte(body))
+		assert.Equal(t, tc.code, code, fmt.Sprintf("case %d", i))
+	}
+
+	body := `{"ref": "refs/heads/deploy", "after": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7", "repository": {"full_name": "WingLim/site"}}`
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewBufferString(body))
+	assert.Nil(t, err)
+	req.Header.Add("X-Github-Event", "push")
+	rec := httptest.NewRecorder()
+	assert.Nil(t, w.ServeHTTP(rec, req, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var data []byte
+	for i := 0; i < 100; i++ {
+		if data, err = ioutil.ReadFile(out); err == nil && len(data) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "push refs/heads/deploy 82b3d5ae55f7080f1e6022629cdb57bfae7cccc7\n", string(data))
+
+	for i, tc := range []*WebHook{
+		{Trigger: webhooks.TriggerPush},
+		{Trigger: webhooks.TriggerPush, Command: []string{"true"}, Previews: "previews"},
+		{Trigger: webhooks.TriggerPush, Command: []string{"true"}, LFS: true},
+	} {
+		assert.NotNil(t, tc.Validate(), fmt.Sprintf("case %d", i))
+	}
+}
+
+func TestCommandSerialized(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook-command")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// The lock directory exists while a run is in progress.
+	w := &WebHook{log: zap.NewNop()}
+	w.cmd = &Cmd{}
+	w.cmd.AddCommand([]string{"sh", "-c", "mkdir lock || touch overlap; sleep 0.05; rmdir lock"}, dir)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = w.runCommand(&webhooks.Event{Name: "push"}, w.log)
+		}()
+	}
+	wg.Wait()
+
+	_, err = os.Stat(filepath.Join(dir, "overlap"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook-ping")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	w := &WebHook{
+		Trigger: webhooks.TriggerPush,
+		Command: []string{"touch", "deployed"},
+		Wait:    true,
+		hook:    webhooks.Github{},
+		log:     zap.NewNop(),
+	}
+	w.cmd = &Cmd{}
+	w.cmd.AddCommand(w.Command, dir)
+
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewBufferString(`{"zen": "Keep it logically awesome."}`))
+	assert.Nil(t, err)
+	req.Header.Add("X-Github-Event", "ping")
+	rec := httptest.NewRecorder()
+	assert.Nil(t, w.ServeHTTP(rec, req, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var resp Response
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, StatusIgnored, resp.Status)
+
+	// The command is not run for pings.
+	_, err = os.Stat(filepath.Join(dir, "deployed"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCodeCommitConfirmation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook-confirmation")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.us-east-1.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	const topic = "arn:aws:sns:us-east-1:123456789012:website"
+	w := &WebHook{
+		Trigger: webhooks.TriggerPush,
+		Command: []string{"touch", "deployed"},
+		Wait:    true,
+		hook:    &webhooks.CodeCommit{Cert: cert, Topics: []string{topic}},
+		log:     zap.NewNop(),
+	}
+	w.cmd = &Cmd{}
+	w.cmd.AddCommand(w.Command, dir)
+
+	msg := map[string]string{
+		"Type":             "UnsubscribeConfirmation",
+		"MessageId":        "165545c9-2a5c-472c-8df2-7ff2be2b3b1b",
+		"Token":            "token",
+		"TopicArn":         topic,
+		"Message":          "You have chosen to deactivate subscription.",
+		"SubscribeURL":     "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription",
+		"Timestamp":        "2021-04-01T10:00:00.000Z",
+		"SignatureVersion": "1",
+	}
+	var toSign string
+	for _, name := range []string{"Message", "MessageId", "SubscribeURL", "Timestamp", "Token", "TopicArn", "Type"} {
+		toSign += name + "\n" + msg[name] + "\n"
+	}
+	digest := sha1.Sum([]byte(toSign))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, digest[:])
+	assert.Nil(t, err)
+	msg["Signature"] = base64.StdEncoding.EncodeToString(signature)
+
+	body, err := json.Marshal(msg)
+	assert.Nil(t, err)
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer(body))
+	assert.Nil(t, err)
+	req.Header.Set("X-Amz-Sns-Message-Type", msg["Type"])
+
+	rec := httptest.NewRecorder()
+	assert.Nil(t, w.ServeHTTP(rec, req, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var resp Response
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, StatusIgnored, resp.Status)
+
+	// The command is not run for confirmations.
+	_, err = os.Stat(filepath.Join(dir, "deployed"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestServeHTTPResponse(t *testing.T) {
+	newWebHook := func(command ...string) *WebHook {
+		w := &WebHook{
+			Trigger: webhooks.TriggerPush,
+			Command: command,
+			Wait:    true,
+			secret:  "secret",
+			hook:    webhooks.Gitee{},
+			log:     zap.NewNop(),
+		}
+		w.cmd = &Cmd{}
+		w.cmd.AddCommand(command, ".")
+		return w
+	}
+	tagsOnly := newWebHook("true")
+	tagsOnly.Events = []string{"Tag Push Hook"}
+	otherSecret := newWebHook("true")
+	otherSecret.secret = "other"
+	notSetup := newWebHook("true")
+	notSetup.Repository = "https://gitee.com/WingLim/site.git"
+	notSetup.repo = &Repo{refName: plumbing.NewBranchReferenceName("main")}
+	notSetupOtherSecret := newWebHook("true")
+	notSetupOtherSecret.repo = &Repo{refName: plumbing.NewBranchReferenceName("main")}
+	notSetupOtherSecret.secret = "other"
+
+	for i, tc := range []struct {
+		webhook *WebHook
+		method  string
+		event   string
+		code    int
+		resp    Response
+	}{
+		{newWebHook("true"), "POST", "Push Hook", http.StatusOK, Response{Status: StatusAccepted, Event: "Push Hook", Result: ResultSucceeded}},
+		{newWebHook("sh", "-c", "echo deploy failed; exit 1"), "POST", "Push Hook", http.StatusInternalServerError,
+			Response{Status: StatusAccepted, Event: "Push Hook", Result: ResultFailed, Reason: "exit status 1: deploy failed"}},
+		{newWebHook("true"), "POST", "", http.StatusBadRequest, Response{Status: StatusRejected, Reason: "header 'X-Gitee-Event' missing"}},
+		{newWebHook("true"), "GET", "Push Hook", http.StatusMethodNotAllowed, Response{Status: StatusRejected, Reason: "only POST method accepted; got GET"}},
+		{newWebHook("true"), "POST", "Note Hook", http.StatusAccepted, Response{Status: StatusIgnored, Reason: `cannot handle "Note Hook" event`}},
+		{tagsOnly, "POST", "Push Hook", http.StatusAccepted, Response{Status: StatusIgnored, Reason: "event: Push Hook, not in events"}},
+		{otherSecret, "POST", "Push Hook", http.StatusForbidden, Response{Status: StatusRejected, Reason: "invalid token"}},
+		{notSetup, "POST", "Push Hook", http.StatusNotFound, Response{Status: StatusRejected, Reason: "repository https://gitee.com/WingLim/site.git not setup"}},
+		{notSetupOtherSecret, "POST", "Push Hook", http.StatusForbidden, Response{Status: StatusRejected, Reason: "invalid token"}},
+	} {
+		req, err := http.NewRequest(tc.method, "/webhook", bytes.NewBufferString(`{"ref": "refs/heads/main", "repository": {"full_name": "WingLim/site"}}`))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.Header.Add("X-Gitee-Token", "secret")
+		if tc.event != "" {
+			req.Header.Add("X-Gitee-Event", tc.event)
+		}
+
+		rec := httptest.NewRecorder()
+		assert.Nil(t, tc.webhook.ServeHTTP(rec, req, nil), fmt.Sprintf("case %d", i))
+		assert.Equal(t, tc.code, rec.Code, fmt.Sprintf("case %d", i))
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"), fmt.Sprintf("case %d", i))
+
+		var resp Response
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp), fmt.Sprintf("case %d", i))
+		if tc.resp.Status == StatusAccepted {
+			assert.Equal(t, 16, len(resp.Job), fmt.Sprintf("case %d", i))
+			resp.Job = ""
+		}
+		assert.Equal(t, tc.resp, resp, fmt.Sprintf("case %d", i))
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	next := caddyhttp.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) error {
+		rw.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+
+	for i, tc := range []struct {
+		passthrough bool
+		method      string
+		event       string
+		code        int
+	}{
+		{true, "GET", "", http.StatusTeapot},
+		{true, "POST", "", http.StatusTeapot},
+		{true, "GET", "Push Hook", http.StatusTeapot},
+		{true, "POST", "Push Hook", http.StatusOK},
+		{false, "GET", "", http.StatusMethodNotAllowed},
+		{false, "POST", "", http.StatusBadRequest},
+	} {
+		w := &WebHook{
+			Type:        "gitee",
+			Trigger:     webhooks.TriggerPush,
+			Passthrough: tc.passthrough,
+			Wait:        true,
+			hook:        webhooks.Gitee{},
+			log:         zap.NewNop(),
+			cmd:         &Cmd{},
+		}
+		w.cmd.AddCommand([]string{"true"}, ".")
+
+		req, err := http.NewRequest(tc.method, "/", bytes.NewBufferString(`{"ref": "refs/heads/main"}`))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		if tc.event != "" {
+			req.Header.Add("X-Gitee-Event", tc.event)
+		}
+
+		rec := httptest.NewRecorder()
+		assert.Nil(t, w.ServeHTTP(rec, req, next), fmt.Sprintf("case %d", i))
+		assert.Equal(t, tc.code, rec.Code, fmt.Sprintf("case %d", i))
+	}
+}
+
+func TestPreviewPlaceholders(t *testing.T) {
+	newWebHook := func(previews string) *WebHook {
+		return &WebHook{
+			Previews: previews,
+			repo:     &Repo{Previews: previews},
+		}
+	}
+
+	single := newWebHook("/srv/previews")
+	repos := &WebHook{
+		Repos: []*WebHook{
+			newWebHook("/srv/previews/site"),
+			newWebHook("/srv/previews/blog"),
+		},
+	}
+
+	for i, tc := range []struct {
+		w      *WebHook
+		host   string
+		path   string
+		number string
+	}{
+		{single, "pr-1.preview.example.com", "/srv/previews/pr-1", "1"},
+		{single, "pr-12.preview.example.com:8443", "/srv/previews/pr-12", "12"},
+		{single, "example.com", "", ""},
+		{single, "pr-x.preview.example.com", "", ""},
+		{single, "pr-0.preview.example.com", "", ""},
+		{newWebHook(""), "pr-1.preview.example.com", "", ""},
+		{repos, "pr-1.blog.preview.example.com", "/srv/previews/blog/pr-1", "1"},
+		{repos, "pr-2.site.preview.example.com", "/srv/previews/site/pr-2", "2"},
+		{repos, "pr-1.other.preview.example.com", "", ""},
+		{repos, "pr-1", "", ""},
+	} {
+		req, err := http.NewRequest("GET", "/", nil)
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.Host = tc.host
+
+		repl := caddy.NewReplacer()
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+		tc.w.setPreviewPlaceholders(req)
+
+		assert.Equal(t, tc.path, repl.ReplaceAll("{webhook.preview.path}", ""), fmt.Sprintf("case %d", i))
+		assert.Equal(t, tc.number, repl.ReplaceAll("{webhook.preview.number}", ""), fmt.Sprintf("case %d", i))
+	}
+}
+
+func TestValidateReposPreviews(t *testing.T) {
+	w := &WebHook{
+		Repos: []*WebHook{
+			{Repository: "https://github.com/WingLim/site.git", Path: "/srv/site", Previews: "/srv/previews/site"},
+			{Repository: "https://github.com/WingLim/blog.git", Path: "/srv/blog", Previews: "/srv/previews/site"},
+		},
+	}
+	err := w.Validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "previews /srv/previews/site is used by another repo")
+
+	w = &WebHook{Repository: "https://github.com/WingLim/site.git", PreviewsForks: true}
+	assert.Equal(t, "previews_forks needs previews", w.Validate().Error())
+}
+
+func TestIsWebhook(t *testing.T) {
+	w := &WebHook{
+		Repos: []*WebHook{
+			{Type: "gitlab"},
+			{Type: "harbor"},
+		},
+	}
+	single := &WebHook{Type: "github"}
+
+	for i, tc := range []struct {
+		webhook *WebHook
+		method  string
+		header  string
+		want    bool
+	}{
+		{single, "POST", "X-Github-Event", true},
+		{single, "POST", "X-Gitlab-Event", false},
+		{single, "GET", "X-Github-Event", false},
+		{&WebHook{}, "POST", "X-Github-Event", true},
+		{&WebHook{Type: "azure"}, "POST", "", true},
+		{w, "POST", "X-Gitlab-Event", true},
+		{w, "POST", "", true},
+		{w, "GET", "X-Gitlab-Event", false},
+	} {
+		req, err := http.NewRequest(tc.method, "/", nil)
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		if tc.header != "" {
+			req.Header.Add(tc.header, "push")
+		}
+
+		assert.Equal(t, tc.want, tc.webhook.isWebhook(req), fmt.Sprintf("case %d", i))
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	w := &WebHook{
+		Trigger:     webhooks.TriggerPush,
+		MaxBodySize: 32,
+		Wait:        true,
+		hook:        webhooks.Gitee{},
+		log:         zap.NewNop(),
+		cmd:         &Cmd{},
+	}
+	w.cmd.AddCommand([]string{"true"}, ".")
+
+	for i, tc := range []struct {
+		body          string
+		contentLength int64
+		code          int
+	}{
+		{`{"ref": "refs/heads/main"}`, -1, http.StatusOK},
+		{`{"ref": "refs/heads/main"}`, 26, http.StatusOK},
+		{`{"ref": "refs/heads/main", "after": "82b3d5ae"}`, -1, http.StatusRequestEntityTooLarge},
+		{`{"ref": "refs/heads/main", "after": "82b3d5ae"}`, 47, http.StatusRequestEntityTooLarge},
+	} {
+		// Without the length, the body is streamed.
+		req, err := http.NewRequest("POST", "/webhook", ioutil.NopCloser(strings.NewReader(tc.body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.ContentLength = tc.contentLength
+		req.Header.Add("X-Gitee-Event", "Push Hook")
+
+		rec := httptest.NewRecorder()
+		assert.Nil(t, w.ServeHTTP(rec, req, nil), fmt.Sprintf("case %d", i))
+		assert.Equal(t, tc.code, rec.Code, fmt.Sprintf("case %d", i))
+	}
+}
+
+func TestValidateTrigger(t *testing.T) {
+	for i, tc := range []struct {
+		webhook *WebHook
+		valid   bool
+	}{
+		{&WebHook{Type: "gitea", Trigger: webhooks.TriggerCI, Secret: "secret", Command: []string{"true"}}, false},
+		{&WebHook{Type: "gitea", Trigger: webhooks.TriggerCI, Command: []string{"true"}}, false},
+		{&WebHook{Type: "gogs", Trigger: webhooks.TriggerCI, Secret: "secret", Command: []string{"true"}}, false},
+		{&WebHook{Type: "gitee", Trigger: webhooks.TriggerCI, Secret: "secret", Command: []string{"true"}}, false},
+		{&WebHook{Type: "gogs", Trigger: webhooks.TriggerPush, Command: []string{"true"}}, true},
+		{&WebHook{Type: "github", Trigger: webhooks.TriggerCI, Secret: "secret", Workflow: "test", Command: []string{"true"}}, true},
+		{&WebHook{Type: "github", Trigger: webhooks.TriggerCI, Secret: "secret", Command: []string{"true"}}, false},
+		{&WebHook{Type: "github", Trigger: webhooks.TriggerPush, Workflow: "test", Command: []string{"true"}}, false},
+		{&WebHook{Type: "gitlab", Trigger: webhooks.TriggerCI, Secret: "secret", Workflow: "test", Command: []string{"true"}}, false},
+	} {
+		err := tc.webhook.Validate()
+		assert.Equal(t, tc.valid, err == nil, fmt.Sprintf("case %d: %v", i, err))
+	}
+}
+
+func TestValidateEvents(t *testing.T) {
+	for i, tc := range []struct {
+		webhook *WebHook
+		valid   bool
+	}{
+		{&WebHook{Trigger: webhooks.TriggerPush, Events: []string{"push", "release"}, Command: []string{"true"}}, true},
+		{&WebHook{Type: "gitlab", Trigger: webhooks.TriggerPush, Events: []string{"Tag Push Hook"}, Command: []string{"true"}}, true},
+		{&WebHook{Type: "gitlab", Trigger: webhooks.TriggerPush, Events: []string{"push"}, Command: []string{"true"}}, false},
+		{&WebHook{Type: "github", Trigger: webhooks.TriggerPush, Events: []string{"Push"}, Command: []string{"true"}}, false},
+		{&WebHook{Type: "gitea", Trigger: webhooks.TriggerPush, Events: []string{"push", "pull_request"}, Command: []string{"true"}}, true},
+	} {
+		err := tc.webhook.Validate()
+		assert.Equal(t, tc.valid, err == nil, fmt.Sprintf("case %d: %v", i, err))
+	}
+}
+
+func TestGiteaAPIURL(t *testing.T) {
+	for i, tc := range []struct {
+		repo string
+		api  string
+	}{
+		{"https://gitea.example.com/WingLim/site.git", "https://gitea.example.com/api/v1/repos/WingLim/site"},
+		{"https://user@gitea.example.com:3000/git/WingLim/site/", "https://gitea.example.com:3000/git/api/v1/repos/WingLim/site"},
+		{"git@gitea.example.com:WingLim/site.git", "https://gitea.example.com/api/v1/repos/WingLim/site"},
+		{"ssh://git@gitea.example.com:2222/WingLim/site.git", "https://gitea.example.com/api/v1/repos/WingLim/site"},
+		{"https://gitea.example.com/site.git", ""},
+		{"/srv/git/site.git", ""},
+		{"", ""},
+	} {
+		assert.Equal(t, tc.api, giteaAPIURL(tc.repo), fmt.Sprintf("case %d", i))
+	}
+}
+
+func TestValidateSNSTopics(t *testing.T) {
+	for i, tc := range []struct {
+		webhook *WebHook
+		valid   bool
+	}{
+		{&WebHook{Type: "codecommit", Trigger: webhooks.TriggerPush, SNSTopics: []string{"arn:aws:sns:us-east-1:123456789012:deploy"}, Command: []string{"true"}}, true},
+		{&WebHook{Type: "codecommit", Trigger: webhooks.TriggerPush, Command: []string{"true"}}, false},
+		{&WebHook{Type: "github", Trigger: webhooks.TriggerPush, SNSTopics: []string{"arn:aws:sns:us-east-1:123456789012:deploy"}, Command: []string{"true"}}, false},
+	} {
+		err := tc.webhook.Validate()
+		assert.Equal(t, tc.valid, err == nil, fmt.Sprintf("case %d: %v", i, err))
+	}
+}
@@ -0,0 +1,172 @@
+package webhooks
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// azureSecretHeader is the header holding the secret, which is added
+// to the HTTP headers of the service hook subscription.
+const azureSecretHeader = "X-Webhook-Secret"
+
+// azureZeroID is the object ID of a deleted ref.
+const azureZeroID = "0000000000000000000000000000000000000000"
+
+// Azure handles service hooks of Azure DevOps Repos.
+type Azure struct {
+}
+
+type azureEvent struct {
+	EventType string `json:"eventType"`
+}
+
+type azurePush struct {
+	Resource struct {
+		Commits []struct {
+			CommitID string `json:"commitId"`
+			Comment  string `json:"comment"`
+		} `json:"commits"`
+		RefUpdates []struct {
+			Name        string `json:"name"`
+			OldObjectID string `json:"oldObjectId"`
+			NewObjectID string `json:"newObjectId"`
+		} `json:"refUpdates"`
+	} `json:"resource"`
+}
+
+type azureRepository struct {
+	Resource struct {
+		Repository struct {
+			Name    string `json:"name"`
+			Project struct {
+				Name string `json:"name"`
+			} `json:"project"`
+			RemoteURL string `json:"remoteUrl"`
+			SSHURL    string `json:"sshUrl"`
+			WebURL    string `json:"webUrl"`
+		} `json:"repository"`
+	} `json:"resource"`
+}
+
+func (a Azure) Handle(r *http.Request, body []byte, hc *HookConf) (*Event, int, error) {
+	err := checkRepository(hc, body, parseAzureRepository)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+
+	err = a.handleSecret(r, hc.Secret)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+
+	var payload azureEvent
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+
+	event := payload.EventType
+	if event == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("field 'eventType' missing")
+	}
+
+	if !hc.HandlesEvent(event) {
+		return nil, http.StatusAccepted, fmt.Errorf("event: %s, not in events", event)
+	}
+
+	switch event {
+	case "git.push":
+		commit, err := a.handlePush(body, hc)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, Ref: hc.RefName.String(), Head: commit}, http.StatusOK, nil
+	default:
+		return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q event", event)
+	}
+}
+
+// handleSecret verifies the secret, given either as the password of
+// the basic authentication or in the X-Webhook-Secret header of the
+// subscription. It is required if the secret is set.
+func (a Azure) handleSecret(r *http.Request, secret string) error {
+	if secret == "" {
+		return nil
+	}
+
+	given := r.Header.Get(azureSecretHeader)
+	if _, password, ok := r.BasicAuth(); ok {
+		given = password
+	}
+	if given == "" {
+		return unauthorized("missing basic authentication or header '%s'", azureSecretHeader)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(given), []byte(secret)) != 1 {
+		return forbidden("invalid secret")
+	}
+	return nil
+}
+
+// handlePush returns the commit the tracked ref was pushed to.
+func (a Azure) handlePush(body []byte, hc *HookConf) (string, error) {
+	var push azurePush
+
+	err := json.Unmarshal(body, &push)
+	if err != nil {
+		return "", err
+	}
+
+	updates := push.Resource.RefUpdates
+	if len(updates) == 0 {
+		return "", fmt.Errorf("the push was incomplete, missing ref updates")
+	}
+
+	for _, update := range updates {
+		refName := plumbing.ReferenceName(update.Name)
+		if refName == hc.RefName {
+			if update.NewObjectID == "" {
+				return "", fmt.Errorf("invalid (empty) commit hash")
+			}
+			if update.NewObjectID == azureZeroID {
+				return "", ignore("event: delete %s", refName)
+			}
+
+			// Azure DevOps lists the comments of the pushed commits,
+			// but not their changed files.
+			var commits []Commit
+			for _, commit := range push.Resource.Commits {
+				commits = append(commits, Commit{ID: commit.CommitID, Message: commit.Comment})
+			}
+			err = filterPush(hc, update.NewObjectID, commits, false)
+			if err != nil {
+				return "", err
+			}
+			return update.NewObjectID, nil
+		}
+	}
+
+	return "", ignore("event: push to %s", updates[0].Name)
+}
+
+func parseAzureRepository(body []byte) (*Repository, error) {
+	var payload azureRepository
+
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := payload.Resource.Repository
+	r := &Repository{
+		URLs: []string{repo.RemoteURL, repo.SSHURL, repo.WebURL},
+	}
+	if repo.Project.Name != "" && repo.Name != "" {
+		r.FullName = repo.Project.Name + "/" + repo.Name
+	}
+	return r, nil
+}
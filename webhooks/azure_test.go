@@ -0,0 +1,233 @@
+package webhooks
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestAzureHandle(t *testing.T) {
+	hc := &HookConf{
+		RefName:       plumbing.ReferenceName("refs/heads/main"),
+		SkipIfMessage: []string{"[skip deploy]"},
+	}
+	azureHook := Azure{}
+
+	for i, test := range []struct {
+		body   string
+		code   int
+		commit string
+	}{
+		{"", http.StatusBadRequest, ""},
+		{`{}`, http.StatusBadRequest, ""},
+		{`{"eventType": "git.pullrequest.created"}`, http.StatusAccepted, ""},
+		{pushAzureBodyValid, http.StatusOK, "33b55f7cb7e7e245323987634f960cf4a6e6bc74"},
+		{pushAzureBodyOtherBranch, http.StatusAccepted, ""},
+		{pushAzureBodyDelete, http.StatusAccepted, ""},
+		{pushAzureBodyTag, http.StatusAccepted, ""},
+		{pushAzureBodySkip, http.StatusAccepted, ""},
+		{`{"eventType": "git.push", "resource": {"refUpdates": []}}`, http.StatusBadRequest, ""},
+	} {
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(test.body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+
+		event, code, _ := handle(azureHook, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+		if code == http.StatusOK {
+			assert.Equal(t, test.commit, event.Head, fmt.Sprintf("case %d", i))
+		}
+	}
+}
+
+func TestAzureTag(t *testing.T) {
+	azureHook := Azure{}
+
+	for i, test := range []struct {
+		refName string
+		code    int
+		commit  string
+	}{
+		{"refs/tags/v1.0.0", http.StatusOK, "33b55f7cb7e7e245323987634f960cf4a6e6bc74"},
+		{"refs/tags/v2.0.0", http.StatusAccepted, ""},
+	} {
+		hc := &HookConf{RefName: plumbing.ReferenceName(test.refName)}
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(pushAzureBodyTag)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+
+		event, code, _ := handle(azureHook, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+		if code == http.StatusOK {
+			assert.Equal(t, test.commit, event.Head, fmt.Sprintf("case %d", i))
+		}
+	}
+}
+
+func TestAzureSecret(t *testing.T) {
+	for i, test := range []struct {
+		secret   string
+		password string
+		header   string
+		code     int
+	}{
+		{"", "", "", http.StatusOK},
+		{"secret", "secret", "", http.StatusOK},
+		{"secret", "", "secret", http.StatusOK},
+		{"secret", "", "", http.StatusUnauthorized},
+		{"secret", "wrong", "", http.StatusForbidden},
+		{"secret", "", "wrong", http.StatusForbidden},
+	} {
+		hc := &HookConf{
+			Secret:  test.secret,
+			RefName: plumbing.ReferenceName("refs/heads/main"),
+		}
+
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(pushAzureBodyValid)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+
+		if test.password != "" {
+			req.SetBasicAuth("azure", test.password)
+		}
+		if test.header != "" {
+			req.Header.Add("X-Webhook-Secret", test.header)
+		}
+
+		_, code, _ := handle(Azure{}, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+	}
+}
+
+func TestAzureRepository(t *testing.T) {
+	for i, test := range []struct {
+		repository string
+		code       int
+	}{
+		{"https://fabrikam@dev.azure.com/fabrikam/Fabrikam-Fiber-Git/_git/website", http.StatusOK},
+		{"git@ssh.dev.azure.com:v3/fabrikam/Fabrikam-Fiber-Git/website", http.StatusOK},
+		{"Fabrikam-Fiber-Git/website", http.StatusOK},
+		{"https://dev.azure.com/fabrikam/Fabrikam-Fiber-Git/_git/other", http.StatusBadRequest},
+	} {
+		hc := &HookConf{
+			Repository: test.repository,
+			RefName:    plumbing.ReferenceName("refs/heads/main"),
+		}
+
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(pushAzureBodyValid)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+
+		_, code, _ := handle(Azure{}, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+	}
+}
+
+var pushAzureBodyValid = `
+{
+	"subscriptionId": "00000000-0000-0000-0000-000000000000",
+	"notificationId": 1,
+	"eventType": "git.push",
+	"publisherId": "tfs",
+	"resource": {
+		"commits": [
+			{
+				"commitId": "33b55f7cb7e7e245323987634f960cf4a6e6bc74",
+				"comment": "Fixed bug in web.config file"
+			}
+		],
+		"refUpdates": [
+			{
+				"name": "refs/heads/main",
+				"oldObjectId": "aad331d8d3b131fa9ae03cf5e53965b51942618a",
+				"newObjectId": "33b55f7cb7e7e245323987634f960cf4a6e6bc74"
+			}
+		],
+		"repository": {
+			"id": "278d5cd2-584d-4b63-824a-2ba458937249",
+			"name": "website",
+			"project": {
+				"name": "Fabrikam-Fiber-Git"
+			},
+			"remoteUrl": "https://fabrikam@dev.azure.com/fabrikam/Fabrikam-Fiber-Git/_git/website",
+			"sshUrl": "git@ssh.dev.azure.com:v3/fabrikam/Fabrikam-Fiber-Git/website",
+			"webUrl": "https://dev.azure.com/fabrikam/Fabrikam-Fiber-Git/_git/website"
+		},
+		"pushId": 14
+	}
+}
+`
+
+var pushAzureBodyOtherBranch = `
+{
+	"eventType": "git.push",
+	"resource": {
+		"refUpdates": [
+			{
+				"name": "refs/heads/develop",
+				"oldObjectId": "aad331d8d3b131fa9ae03cf5e53965b51942618a",
+				"newObjectId": "33b55f7cb7e7e245323987634f960cf4a6e6bc74"
+			}
+		]
+	}
+}
+`
+
+var pushAzureBodyDelete = `
+{
+	"eventType": "git.push",
+	"resource": {
+		"refUpdates": [
+			{
+				"name": "refs/heads/main",
+				"oldObjectId": "33b55f7cb7e7e245323987634f960cf4a6e6bc74",
+				"newObjectId": "0000000000000000000000000000000000000000"
+			}
+		]
+	}
+}
+`
+
+var pushAzureBodyTag = `
+{
+	"eventType": "git.push",
+	"resource": {
+		"refUpdates": [
+			{
+				"name": "refs/tags/v1.0.0",
+				"oldObjectId": "0000000000000000000000000000000000000000",
+				"newObjectId": "33b55f7cb7e7e245323987634f960cf4a6e6bc74"
+			}
+		]
+	}
+}
+`
+
+var pushAzureBodySkip = `
+{
+	"eventType": "git.push",
+	"resource": {
+		"commits": [
+			{
+				"commitId": "33b55f7cb7e7e245323987634f960cf4a6e6bc74",
+				"comment": "Update docs [skip deploy]"
+			},
+			{
+				"commitId": "aad331d8d3b131fa9ae03cf5e53965b51942618a",
+				"comment": "Fixed bug in web.config file"
+			}
+		],
+		"refUpdates": [
+			{
+				"name": "refs/heads/main",
+				"oldObjectId": "aad331d8d3b131fa9ae03cf5e53965b51942618a",
+				"newObjectId": "33b55f7cb7e7e245323987634f960cf4a6e6bc74"
+			}
+		]
+	}
+}
+`
@@ -1,14 +1,14 @@
 package webhooks
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net"
 	"net/http"
-	"strings"
-	"sync"
-	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
 )
 
 type Bitbucket struct {
@@ -18,157 +18,150 @@ type bbPush struct {
 	Push struct {
 		Changes []struct {
 			New struct {
-				Type string `json:"type,omitempty"`
-				Name string `json:"name,omitempty"`
+				Type   string `json:"type,omitempty"`
+				Name   string `json:"name,omitempty"`
+				Target struct {
+					Hash string `json:"hash,omitempty"`
+				} `json:"target,omitempty"`
 			} `json:"new,omitempty"`
+			Commits []struct {
+				Hash    string `json:"hash,omitempty"`
+				Message string `json:"message,omitempty"`
+			} `json:"commits,omitempty"`
 		} `json:"changes,omitempty"`
 	} `json:"push,omitempty"`
 }
 
-func (b Bitbucket) Handle(r *http.Request, hc *HookConf) (int, error) {
-	if !b.verifyBitbucketIP(r.RemoteAddr) {
-		return http.StatusForbidden, fmt.Errorf("the request doesn't come from a valid IP")
+type bbRepository struct {
+	Repository struct {
+		FullName string `json:"full_name"`
+		Links    struct {
+			HTML struct {
+				Href string `json:"href"`
+			} `json:"html"`
+		} `json:"links"`
+	} `json:"repository"`
+}
+
+func (b Bitbucket) Handle(r *http.Request, body []byte, hc *HookConf) (*Event, int, error) {
+	err := checkRepository(hc, body, parseBitbucketRepository)
+	if err != nil {
+		return nil, statusCode(err), err
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	err = handleHubSignature(r, body, hc.Secret)
 	if err != nil {
-		return http.StatusBadRequest, err
+		return nil, statusCode(err), err
 	}
 
 	event := r.Header.Get("X-Event-Key")
 	if event == "" {
-		return http.StatusBadRequest, fmt.Errorf("header 'X-Event-Key' missing")
+		return nil, http.StatusBadRequest, fmt.Errorf("header 'X-Event-Key' missing")
+	}
+
+	if !hc.HandlesEvent(event) {
+		return nil, http.StatusAccepted, fmt.Errorf("event: %s, not in events", event)
 	}
 
 	switch event {
 	case "repo:push":
-		err = b.handlePush(body, hc)
+		commit, err := b.handlePush(body, hc)
 		if err != nil {
-			return http.StatusBadRequest, err
+			return nil, statusCode(err), err
 		}
+		return &Event{Name: event, Ref: hc.RefName.String(), Head: commit}, http.StatusOK, nil
 	default:
-		return http.StatusBadRequest, fmt.Errorf("cannot handle %q event", event)
+		return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q event", event)
 	}
-	return http.StatusOK, nil
 }
 
-func (b Bitbucket) handlePush(body []byte, hc *HookConf) error {
+// handleHubSignature verifies the sha256 X-Hub-Signature header of
+// Bitbucket Cloud and Server, which is required if the secret is set.
+func handleHubSignature(r *http.Request, body []byte, secret string) error {
+	signature := r.Header.Get("X-Hub-Signature")
+	if signature == "" {
+		if secret != "" {
+			return unauthorized("header 'X-Hub-Signature' missing")
+		}
+		return nil
+	}
+	if secret == "" {
+		return forbidden("empty webhook secret")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expectedMac := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(signature), []byte(expectedMac)) {
+		return forbidden("invalid signature")
+	}
+	return nil
+}
+
+func parseBitbucketRepository(body []byte) (*Repository, error) {
+	var payload bbRepository
+
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := payload.Repository
+	return &Repository{
+		FullName: repo.FullName,
+		URLs:     []string{repo.Links.HTML.Href},
+	}, nil
+}
+
+// handlePush returns the commit the tracked tag was pushed to, or
+// empty for the tracked branch.
+func (b Bitbucket) handlePush(body []byte, hc *HookConf) (string, error) {
 	var push bbPush
 
 	err := json.Unmarshal(body, &push)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	if len(push.Push.Changes) == 0 {
-		return fmt.Errorf("the push was incomplete, missing change list")
+		return "", fmt.Errorf("the push was incomplete, missing change list")
 	}
 
 	change := push.Push.Changes[0]
 	if len(change.New.Name) == 0 {
-		return fmt.Errorf("the push didn't contain a valid branch name")
+		return "", fmt.Errorf("the push didn't contain a valid branch name")
 	}
 
 	refType := change.New.Type
 	if refType == "" {
-		return fmt.Errorf("the push didn't cotain type")
+		return "", fmt.Errorf("the push didn't cotain type")
 	}
 
 	refName := change.New.Name
-	if refType == "branch" {
-		if refName != hc.RefName.Short() {
-			return fmt.Errorf("event: push to branch %s", refName)
-		}
-	} else {
-		return fmt.Errorf("refName is not a branch: %s", refName)
-	}
-
-	return nil
-}
-
-func hostOnly(remoteAddr string) string {
-	host, _, _ := net.SplitHostPort(remoteAddr)
-	if host == "" {
-		return remoteAddr
-	}
-	return host
-}
-
-func (b Bitbucket) verifyBitbucketIP(remoteAddr string) bool {
-	ipAddress := net.ParseIP(hostOnly(remoteAddr))
-
-	if err := updateBitBucketIPs(); err != nil && len(atlassianIPs.Items) == 0 {
-		return false
-	}
-
-	atlassianIPsMu.Lock()
-	ipItems := atlassianIPs.Items
-	atlassianIPsMu.Unlock()
-
-	for _, item := range ipItems {
-		if !strings.Contains(item.CIDR, "") {
-			ip := net.ParseIP(item.CIDR)
-			if ip.Equal(ipAddress) {
-				return true
-			}
-			continue
-		}
-
-		_, cidrnet, err := net.ParseCIDR(item.CIDR)
-		if err != nil {
-			continue
+	switch refType {
+	case "branch":
+		if plumbing.NewBranchReferenceName(refName) != hc.RefName {
+			return "", ignore("event: push to branch %s", refName)
 		}
 
-		if cidrnet.Contains(ipAddress) {
-			return true
+		// Bitbucket lists commits from the newest, without the changed
+		// files, so only messages can be checked.
+		commits := make([]Commit, len(change.Commits))
+		for i, commit := range change.Commits {
+			commits[len(commits)-1-i] = Commit{ID: commit.Hash, Message: commit.Message}
 		}
-	}
-	return false
-}
-
-type atlassianIPResponse struct {
-	CreationDate string             `json:"creationDate"`
-	SyncToken    int                `json:"syncToken"`
-	Items        []atlassianIPRange `json:"items"`
-
-	lastUpdated time.Time
-}
-
-type atlassianIPRange struct {
-	Network string `json:"network"`
-	MaskLen int    `json:"mask_len"`
-	CIDR    string `json:"cidr"`
-	Mask    string `json:"mask"`
-}
-
-var (
-	atlassianIPs   atlassianIPResponse
-	atlassianIPsMu sync.Mutex
-)
-
-func updateBitBucketIPs() error {
-	atlassianIPsMu.Lock()
-	defer atlassianIPsMu.Unlock()
-
-	if atlassianIPs.lastUpdated.IsZero() || time.Since(atlassianIPs.lastUpdated) > 24*time.Hour {
-		resp, err := http.Get("https://ip-ranges.atlassian.com/")
+		err = filterPush(hc, change.New.Target.Hash, commits, false)
 		if err != nil {
-			return fmt.Errorf("fail to request recent IPs for bitbucket: %v", err)
+			return "", err
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("fail to request recent IPs for bitbucket: HTTP %d", resp.StatusCode)
+		return change.New.Target.Hash, nil
+	case "tag":
+		if plumbing.NewTagReferenceName(refName) != hc.RefName {
+			return "", ignore("event: push to tag %s", refName)
 		}
-
-		var newIPs atlassianIPResponse
-		err = json.NewDecoder(resp.Body).Decode(&newIPs)
-		if err != nil {
-			return fmt.Errorf("fail to decode recent IPs for bitbucket: %v", err)
-		}
-
-		newIPs.lastUpdated = time.Now()
-		atlassianIPs = newIPs
+		return change.New.Target.Hash, nil
+	default:
+		return "", ignore("refName is neither a branch nor a tag: %s", refName)
 	}
-	return nil
 }
@@ -2,10 +2,12 @@ package webhooks
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"testing"
-	"time"
 
 	"github.com/alecthomas/assert"
 	"github.com/go-git/go-git/v5/plumbing"
@@ -13,61 +15,98 @@ import (
 
 func TestBitbucketHandle(t *testing.T) {
 	hc := &HookConf{
-		RefName: plumbing.ReferenceName("refs/heads/main"),
+		RefName:       plumbing.ReferenceName("refs/heads/main"),
+		SkipIfMessage: []string{"[skip deploy]"},
 	}
 	bbHook := Bitbucket{}
 
-	remoteIP := "18.246.31.128"
-	remoteIPv6 := "2600:1f18:2146:e306:939f:d1b3:aa36:ac42"
-	atlassianIPsMu.Lock()
-	atlassianIPs = atlassianIPResponse{
-		Items: []atlassianIPRange{
-			{
-				Network: remoteIP,
-				MaskLen: 25,
-				CIDR:    remoteIP + "/25",
-				Mask:    "255.255.255.128",
-			},
-			{
-				Network: "2600:1f18:2146:e306:939f:d1b3:aa36:ac42",
-				MaskLen: 56,
-				CIDR:    "2600:1f18:2146:e300::/56",
-				Mask:    "ffff:ffff:ffff:ff00::",
-			},
-		},
-		lastUpdated: time.Now(),
-	}
-	atlassianIPsMu.Unlock()
-
 	for i, test := range []struct {
-		ip    string
 		body  string
 		event string
 		code  int
 	}{
-		{remoteIP, "", "", http.StatusBadRequest},
-		{"131.103.20.160", "", "repo:push", http.StatusForbidden},
-		{remoteIP, "", "repo:push", http.StatusBadRequest},
-		{remoteIP, pushBBBodyValid, "repo:push", http.StatusOK},
-		{remoteIPv6, pushBBBodyValid, "repo:push", http.StatusOK},
-		{remoteIP, pushBBBodyEmptyBranch, "repo:push", http.StatusBadRequest},
-		{remoteIP, pushBBBodyDeleteBranch, "repo:push", http.StatusBadRequest},
+		{"", "", http.StatusBadRequest},
+		{"", "repo:push", http.StatusBadRequest},
+		{pushBBBodyValid, "repo:push", http.StatusOK},
+		{pushBBBodyEmptyBranch, "repo:push", http.StatusBadRequest},
+		{pushBBBodyDeleteBranch, "repo:push", http.StatusBadRequest},
+		{pushBBBodyTag, "repo:push", http.StatusAccepted},
+		{pushBBBodySkip, "repo:push", http.StatusAccepted},
 	} {
 		req, err := http.NewRequest("POST", "", bytes.NewBuffer([]byte(test.body)))
 		assert.Nil(t, err, fmt.Sprintf("case %d", i))
 
-		req.RemoteAddr = test.ip
-
 		if test.event != "" {
 			req.Header.Add("X-Event-Key", test.event)
 		}
 
-		code, _ := bbHook.Handle(req, hc)
+		_, code, _ := handle(bbHook, req, hc)
 
 		assert.Equal(t, code, test.code, fmt.Sprintf("case %d", i))
 	}
 }
 
+func TestBitbucketTag(t *testing.T) {
+	bbHook := Bitbucket{}
+
+	for i, test := range []struct {
+		refName string
+		code    int
+		commit  string
+	}{
+		{"refs/tags/v1.0.0", http.StatusOK, "4b3c2e1d5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c"},
+		{"refs/tags/v2.0.0", http.StatusAccepted, ""},
+	} {
+		hc := &HookConf{RefName: plumbing.ReferenceName(test.refName)}
+		req, err := http.NewRequest("POST", "", bytes.NewBuffer([]byte(pushBBBodyTag)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.Header.Add("X-Event-Key", "repo:push")
+
+		event, code, _ := handle(bbHook, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+		if code == http.StatusOK {
+			assert.Equal(t, test.commit, event.Head, fmt.Sprintf("case %d", i))
+		}
+	}
+}
+
+func TestBitbucketSignature(t *testing.T) {
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(pushBBBodyValid))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	for i, test := range []struct {
+		secret    string
+		signature string
+		code      int
+	}{
+		{"", "", http.StatusOK},
+		{"secret", signature, http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "sha256=0123", http.StatusForbidden},
+		{"secret", signature[len("sha256="):], http.StatusForbidden},
+		{"", signature, http.StatusForbidden},
+	} {
+		hc := &HookConf{
+			Secret:  test.secret,
+			RefName: plumbing.ReferenceName("refs/heads/main"),
+		}
+
+		req, err := http.NewRequest("POST", "", bytes.NewBuffer([]byte(pushBBBodyValid)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+
+		req.Header.Add("X-Event-Key", "repo:push")
+		if test.signature != "" {
+			req.Header.Add("X-Hub-Signature", test.signature)
+		}
+
+		_, code, _ := handle(Bitbucket{}, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+	}
+}
+
 var pushBBBodyEmptyBranch = `
 {
 	"push": {
@@ -106,3 +145,49 @@ var pushBBBodyDeleteBranch = `
 	}
 }
 `
+
+var pushBBBodyTag = `
+{
+	"push": {
+		"changes": [
+			{
+				"new": {
+					"type": "tag",
+					"name": "v1.0.0",
+					"target": {
+						"hash": "4b3c2e1d5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c"
+					}
+				}
+			}
+		]
+	}
+}
+`
+
+var pushBBBodySkip = `
+{
+	"push": {
+		"changes": [
+			{
+				"new": {
+					"type": "branch",
+					"name": "main",
+					"target": {
+						"hash": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"
+					}
+				},
+				"commits": [
+					{
+						"hash": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7",
+						"message": "fix typo [skip deploy]"
+					},
+					{
+						"hash": "3bbc1d8d3d4d1e9f8b0f5f5a0e4e0d5b6c7a8b9c",
+						"message": "update site"
+					}
+				]
+			}
+		]
+	}
+}
+`
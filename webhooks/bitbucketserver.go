@@ -0,0 +1,124 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// BitbucketServer handles webhooks of Bitbucket Server and Data Center.
+type BitbucketServer struct {
+}
+
+type bbsRefsChanged struct {
+	Changes []struct {
+		Ref struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		} `json:"ref"`
+		ToHash string `json:"toHash"`
+		Type   string `json:"type"`
+	} `json:"changes"`
+}
+
+type bbsRepository struct {
+	Repository struct {
+		Slug    string `json:"slug"`
+		Project struct {
+			Key string `json:"key"`
+		} `json:"project"`
+		Links struct {
+			Clone []struct {
+				Href string `json:"href"`
+			} `json:"clone"`
+		} `json:"links"`
+	} `json:"repository"`
+}
+
+func (b BitbucketServer) Handle(r *http.Request, body []byte, hc *HookConf) (*Event, int, error) {
+	event := r.Header.Get("X-Event-Key")
+	if event == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("header 'X-Event-Key' missing")
+	}
+
+	// Test connection requests are for no repository.
+	if event != "diagnostics:ping" {
+		err := checkRepository(hc, body, parseBitbucketServerRepository)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+	}
+
+	err := handleHubSignature(r, body, hc.Secret)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+
+	if !hc.HandlesEvent(event) {
+		return nil, http.StatusAccepted, fmt.Errorf("event: %s, not in events", event)
+	}
+
+	switch event {
+	case "diagnostics:ping":
+		return &Event{Name: event, Ping: true}, http.StatusOK, nil
+	case "repo:refs_changed":
+		commit, err := b.handleRefsChanged(body, hc)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, Ref: hc.RefName.String(), Head: commit}, http.StatusOK, nil
+	default:
+		return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q event", event)
+	}
+}
+
+// handleRefsChanged returns the commit the tracked ref was pushed to.
+func (b BitbucketServer) handleRefsChanged(body []byte, hc *HookConf) (string, error) {
+	var push bbsRefsChanged
+
+	err := json.Unmarshal(body, &push)
+	if err != nil {
+		return "", err
+	}
+
+	if len(push.Changes) == 0 {
+		return "", fmt.Errorf("the push was incomplete, missing change list")
+	}
+
+	for _, change := range push.Changes {
+		refName := plumbing.ReferenceName(change.Ref.ID)
+		if refName == hc.RefName {
+			if change.Type == "DELETE" {
+				return "", ignore("event: delete %s", refName)
+			}
+			if change.ToHash == "" {
+				return "", fmt.Errorf("invalid (empty) commit hash")
+			}
+			return change.ToHash, nil
+		}
+	}
+
+	return "", ignore("event: push to %s", push.Changes[0].Ref.ID)
+}
+
+func parseBitbucketServerRepository(body []byte) (*Repository, error) {
+	var payload bbsRepository
+
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := payload.Repository
+	r := &Repository{}
+	if repo.Project.Key != "" && repo.Slug != "" {
+		r.FullName = strings.ToLower(repo.Project.Key) + "/" + repo.Slug
+	}
+	for _, clone := range repo.Links.Clone {
+		r.URLs = append(r.URLs, clone.Href)
+	}
+	return r, nil
+}
@@ -0,0 +1,229 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestBitbucketServerHandle(t *testing.T) {
+	hc := &HookConf{
+		RefName: plumbing.ReferenceName("refs/heads/main"),
+	}
+	bbsHook := BitbucketServer{}
+
+	for i, test := range []struct {
+		body   string
+		event  string
+		code   int
+		commit string
+	}{
+		{"", "", http.StatusBadRequest, ""},
+		{"", "repo:refs_changed", http.StatusBadRequest, ""},
+		{refsChangedBBSBodyValid, "repo:refs_changed", http.StatusOK, "4b3c2e1d5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c"},
+		{refsChangedBBSBodyOtherBranch, "repo:refs_changed", http.StatusAccepted, ""},
+		{refsChangedBBSBodyDelete, "repo:refs_changed", http.StatusAccepted, ""},
+		{refsChangedBBSBodyTag, "repo:refs_changed", http.StatusAccepted, ""},
+		{`{"changes": []}`, "repo:refs_changed", http.StatusBadRequest, ""},
+		{`{"test": true}`, "diagnostics:ping", http.StatusOK, ""},
+		{refsChangedBBSBodyValid, "pr:opened", http.StatusAccepted, ""},
+	} {
+		req, err := http.NewRequest("POST", "", bytes.NewBuffer([]byte(test.body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+
+		if test.event != "" {
+			req.Header.Add("X-Event-Key", test.event)
+		}
+
+		event, code, _ := handle(bbsHook, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+		if code == http.StatusOK {
+			assert.Equal(t, test.commit, event.Head, fmt.Sprintf("case %d", i))
+		}
+	}
+}
+
+func TestBitbucketServerTag(t *testing.T) {
+	bbsHook := BitbucketServer{}
+
+	for i, test := range []struct {
+		refName string
+		code    int
+		commit  string
+	}{
+		{"refs/tags/v1.0.0", http.StatusOK, "4b3c2e1d5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c"},
+		{"refs/tags/v2.0.0", http.StatusAccepted, ""},
+	} {
+		hc := &HookConf{RefName: plumbing.ReferenceName(test.refName)}
+		req, err := http.NewRequest("POST", "", bytes.NewBuffer([]byte(refsChangedBBSBodyTag)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.Header.Add("X-Event-Key", "repo:refs_changed")
+
+		event, code, _ := handle(bbsHook, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+		if code == http.StatusOK {
+			assert.Equal(t, test.commit, event.Head, fmt.Sprintf("case %d", i))
+		}
+	}
+}
+
+func TestBitbucketServerSignature(t *testing.T) {
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(refsChangedBBSBodyValid))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	for i, test := range []struct {
+		secret    string
+		signature string
+		code      int
+	}{
+		{"", "", http.StatusOK},
+		{"secret", signature, http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "sha256=0123", http.StatusForbidden},
+		{"", signature, http.StatusForbidden},
+	} {
+		hc := &HookConf{
+			Secret:  test.secret,
+			RefName: plumbing.ReferenceName("refs/heads/main"),
+		}
+
+		req, err := http.NewRequest("POST", "", bytes.NewBuffer([]byte(refsChangedBBSBodyValid)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+
+		req.Header.Add("X-Event-Key", "repo:refs_changed")
+		if test.signature != "" {
+			req.Header.Add("X-Hub-Signature", test.signature)
+		}
+
+		_, code, _ := handle(BitbucketServer{}, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+	}
+}
+
+func TestBitbucketServerRepository(t *testing.T) {
+	for i, test := range []struct {
+		repository string
+		code       int
+	}{
+		{"", http.StatusOK},
+		{"proj/website", http.StatusOK},
+		{"https://bitbucket.example.com/scm/proj/website.git", http.StatusOK},
+		{"ssh://git@bitbucket.example.com:7999/proj/website.git", http.StatusOK},
+		{"proj/other", http.StatusBadRequest},
+		{"https://bitbucket.example.com/scm/proj/other.git", http.StatusBadRequest},
+	} {
+		hc := &HookConf{
+			Repository: test.repository,
+			RefName:    plumbing.ReferenceName("refs/heads/main"),
+		}
+
+		req, err := http.NewRequest("POST", "", bytes.NewBuffer([]byte(refsChangedBBSBodyValid)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.Header.Add("X-Event-Key", "repo:refs_changed")
+
+		_, code, _ := handle(BitbucketServer{}, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+	}
+}
+
+var refsChangedBBSBodyValid = `
+{
+	"eventKey": "repo:refs_changed",
+	"date": "2021-04-01T10:00:00+0000",
+	"repository": {
+		"slug": "website",
+		"name": "website",
+		"project": {
+			"key": "PROJ",
+			"name": "Project"
+		},
+		"links": {
+			"clone": [
+				{
+					"href": "ssh://git@bitbucket.example.com:7999/proj/website.git",
+					"name": "ssh"
+				},
+				{
+					"href": "https://bitbucket.example.com/scm/proj/website.git",
+					"name": "http"
+				}
+			]
+		}
+	},
+	"changes": [
+		{
+			"ref": {
+				"id": "refs/heads/main",
+				"displayId": "main",
+				"type": "BRANCH"
+			},
+			"refId": "refs/heads/main",
+			"fromHash": "1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b",
+			"toHash": "4b3c2e1d5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c",
+			"type": "UPDATE"
+		}
+	]
+}
+`
+
+var refsChangedBBSBodyOtherBranch = `
+{
+	"changes": [
+		{
+			"ref": {
+				"id": "refs/heads/develop",
+				"displayId": "develop",
+				"type": "BRANCH"
+			},
+			"toHash": "4b3c2e1d5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c",
+			"type": "UPDATE"
+		}
+	]
+}
+`
+
+var refsChangedBBSBodyDelete = `
+{
+	"changes": [
+		{
+			"ref": {
+				"id": "refs/heads/main",
+				"displayId": "main",
+				"type": "BRANCH"
+			},
+			"fromHash": "4b3c2e1d5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c",
+			"toHash": "0000000000000000000000000000000000000000",
+			"type": "DELETE"
+		}
+	]
+}
+`
+
+var refsChangedBBSBodyTag = `
+{
+	"changes": [
+		{
+			"ref": {
+				"id": "refs/tags/v1.0.0",
+				"displayId": "v1.0.0",
+				"type": "TAG"
+			},
+			"fromHash": "0000000000000000000000000000000000000000",
+			"toHash": "4b3c2e1d5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c",
+			"type": "ADD"
+		}
+	]
+}
+`
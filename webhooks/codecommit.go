@@ -0,0 +1,390 @@
+package webhooks
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// snsHost matches the hosts of Amazon SNS, which subscriptions are
+// confirmed and signing certificates fetched from by default.
+var snsHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// snsTimeout is the timeout to confirm subscriptions and fetch
+// signing certificates.
+const snsTimeout = 10 * time.Second
+
+// CodeCommit handles Amazon SNS notifications of AWS CodeCommit
+// repository state change events, sent by an EventBridge rule.
+type CodeCommit struct {
+	// Cert is the certificate to verify the signature of messages.
+	// If nil, it is fetched from the signing certificate URL of the
+	// message, which must be allowed by URLs.
+	Cert *x509.Certificate
+
+	// Topics are the ARNs of the SNS topics messages are accepted
+	// from. Messages from other topics are rejected.
+	Topics []string
+
+	// URLs allowed to confirm subscriptions and fetch signing
+	// certificates from, such as `https://sns.*.amazonaws.com`. Each
+	// label of the host may be a wildcard. Default to the HTTPS URLs
+	// of the hosts of Amazon SNS.
+	URLs []string
+
+	// Client to confirm subscriptions and fetch signing certificates.
+	// Default to http.DefaultClient.
+	Client *http.Client
+
+	mu    sync.Mutex
+	certs map[string]*x509.Certificate
+}
+
+type snsMessage struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	SubscribeURL     string `json:"SubscribeURL"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+}
+
+type ccStateChange struct {
+	DetailType string `json:"detail-type"`
+	Region     string `json:"region"`
+	Detail     struct {
+		Event             string `json:"event"`
+		RepositoryName    string `json:"repositoryName"`
+		ReferenceFullName string `json:"referenceFullName"`
+		CommitID          string `json:"commitId"`
+	} `json:"detail"`
+}
+
+func (c *CodeCommit) Handle(r *http.Request, body []byte, hc *HookConf) (*Event, int, error) {
+	event := r.Header.Get("X-Amz-Sns-Message-Type")
+	if event == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("header 'X-Amz-Sns-Message-Type' missing")
+	}
+
+	var msg snsMessage
+	err := json.Unmarshal(body, &msg)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+	if msg.Type != event {
+		return nil, http.StatusBadRequest, fmt.Errorf("message type %q, not %q", msg.Type, event)
+	}
+
+	// Subscription confirmations are for no repository.
+	if event == "Notification" {
+		err = checkRepository(hc, []byte(msg.Message), parseCodeCommitRepository)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+	}
+
+	err = c.handleSignature(r.Context(), &msg)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+
+	if !c.allowedTopic(msg.TopicArn) {
+		err = forbidden("topic %q is not allowed", msg.TopicArn)
+		return nil, statusCode(err), err
+	}
+
+	// Confirmations set up the subscription, so they are not deployed.
+	switch event {
+	case "SubscriptionConfirmation":
+		err = c.confirmSubscription(r.Context(), &msg)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, Ping: true}, http.StatusOK, nil
+	case "UnsubscribeConfirmation":
+		return &Event{Name: event, Ping: true}, http.StatusOK, nil
+	case "Notification":
+		commit, err := c.handleStateChange([]byte(msg.Message), hc)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, Ref: hc.RefName.String(), Head: commit}, http.StatusOK, nil
+	default:
+		return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q message", event)
+	}
+}
+
+// handleSignature verifies the signature of the message.
+func (c *CodeCommit) handleSignature(ctx context.Context, msg *snsMessage) error {
+	if msg.Signature == "" {
+		return unauthorized("field 'Signature' missing")
+	}
+
+	var hash crypto.Hash
+	switch msg.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	default:
+		return fmt.Errorf("unknown signature version %q", msg.SignatureVersion)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return forbidden("invalid signature: %v", err)
+	}
+
+	cert := c.Cert
+	if cert == nil {
+		cert, err = c.signingCert(ctx, msg.SigningCertURL)
+		if err != nil {
+			return forbidden("%v", err)
+		}
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return forbidden("signing certificate has no RSA public key")
+	}
+
+	var digest []byte
+	if hash == crypto.SHA1 {
+		sum := sha1.Sum([]byte(snsStringToSign(msg)))
+		digest = sum[:]
+	} else {
+		sum := sha256.Sum256([]byte(snsStringToSign(msg)))
+		digest = sum[:]
+	}
+
+	if rsa.VerifyPKCS1v15(key, hash, digest, signature) != nil {
+		return forbidden("invalid signature")
+	}
+	return nil
+}
+
+// snsStringToSign returns the string SNS signs for the message, which
+// is the names and values of its fields, one per line.
+func snsStringToSign(msg *snsMessage) string {
+	fields := [][2]string{{"Message", msg.Message}, {"MessageId", msg.MessageID}}
+	if msg.Type == "Notification" {
+		if msg.Subject != "" {
+			fields = append(fields, [2]string{"Subject", msg.Subject})
+		}
+		fields = append(fields,
+			[2]string{"Timestamp", msg.Timestamp},
+			[2]string{"TopicArn", msg.TopicArn},
+			[2]string{"Type", msg.Type})
+	} else {
+		fields = append(fields,
+			[2]string{"SubscribeURL", msg.SubscribeURL},
+			[2]string{"Timestamp", msg.Timestamp},
+			[2]string{"Token", msg.Token},
+			[2]string{"TopicArn", msg.TopicArn},
+			[2]string{"Type", msg.Type})
+	}
+
+	var b strings.Builder
+	for _, field := range fields {
+		b.WriteString(field[0] + "\n" + field[1] + "\n")
+	}
+	return b.String()
+}
+
+// signingCert returns the certificate at the signing certificate URL,
+// which is fetched once.
+func (c *CodeCommit) signingCert(ctx context.Context, certURL string) (*x509.Certificate, error) {
+	if !c.allowed(certURL) {
+		return nil, fmt.Errorf("signing certificate URL %q is not allowed", certURL)
+	}
+
+	c.mu.Lock()
+	cert, ok := c.certs[certURL]
+	c.mu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	body, err := c.get(ctx, certURL)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, fmt.Errorf("signing certificate: no PEM data")
+	}
+	cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("signing certificate: %v", err)
+	}
+
+	c.mu.Lock()
+	if c.certs == nil {
+		c.certs = make(map[string]*x509.Certificate)
+	}
+	c.certs[certURL] = cert
+	c.mu.Unlock()
+	return cert, nil
+}
+
+// confirmSubscription confirms the subscription of the topic by
+// visiting the subscribe URL of the message.
+func (c *CodeCommit) confirmSubscription(ctx context.Context, msg *snsMessage) error {
+	if !c.allowed(msg.SubscribeURL) {
+		return forbidden("subscribe URL %q is not allowed", msg.SubscribeURL)
+	}
+
+	_, err := c.get(ctx, msg.SubscribeURL)
+	if err != nil {
+		return fmt.Errorf("confirming subscription to %s: %v", msg.TopicArn, err)
+	}
+	return nil
+}
+
+// allowedTopic reports whether the topic is one of the Topics.
+func (c *CodeCommit) allowedTopic(topic string) bool {
+	for _, t := range c.Topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether rawURL is allowed by the URLs, or is an
+// HTTPS URL of Amazon SNS without URLs.
+func (c *CodeCommit) allowed(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	if len(c.URLs) == 0 {
+		return u.Scheme == "https" && snsHost.MatchString(u.Host)
+	}
+	for _, pattern := range c.URLs {
+		p, err := url.Parse(pattern)
+		if err != nil || p.Scheme != u.Scheme {
+			continue
+		}
+		if matchHost(p.Host, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost reports whether host matches pattern label by label, so
+// that a wildcard never matches across dots.
+func matchHost(pattern, host string) bool {
+	patterns, labels := strings.Split(pattern, "."), strings.Split(host, ".")
+	if len(patterns) != len(labels) {
+		return false
+	}
+	for i, p := range patterns {
+		if ok, _ := path.Match(p, labels[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *CodeCommit) get(ctx context.Context, rawURL string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, snsTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: HTTP %d", req.URL.Host+req.URL.Path, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// handleStateChange returns the commit the tracked ref was updated
+// to.
+func (c *CodeCommit) handleStateChange(message []byte, hc *HookConf) (string, error) {
+	var change ccStateChange
+
+	err := json.Unmarshal(message, &change)
+	if err != nil {
+		return "", err
+	}
+
+	if change.DetailType != "CodeCommit Repository State Change" {
+		return "", ignore("event: %s", change.DetailType)
+	}
+
+	detail := change.Detail
+	refName := plumbing.ReferenceName(detail.ReferenceFullName)
+	if refName != hc.RefName {
+		return "", ignore("event: %s %s", detail.Event, refName)
+	}
+
+	switch detail.Event {
+	case "referenceCreated", "referenceUpdated":
+	default:
+		return "", ignore("event: %s %s", detail.Event, refName)
+	}
+	if detail.CommitID == "" {
+		return "", fmt.Errorf("invalid (empty) commit id")
+	}
+	return detail.CommitID, nil
+}
+
+// parseCodeCommitRepository parses the repository of the CodeCommit
+// event in the message of a notification.
+func parseCodeCommitRepository(message []byte) (*Repository, error) {
+	var change ccStateChange
+
+	err := json.Unmarshal(message, &change)
+	if err != nil {
+		return nil, err
+	}
+
+	name := change.Detail.RepositoryName
+	r := &Repository{FullName: name}
+	if name != "" && change.Region != "" {
+		host := "git-codecommit." + change.Region + ".amazonaws.com"
+		r.URLs = []string{
+			"https://" + host + "/v1/repos/" + name,
+			"ssh://" + host + "/v1/repos/" + name,
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,289 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// snsTopic is the ARN of the topic the test messages are from.
+const snsTopic = "arn:aws:sns:us-east-1:123456789012:deploy"
+
+// snsSigner signs SNS messages with a locally generated certificate.
+type snsSigner struct {
+	key     *rsa.PrivateKey
+	cert    *x509.Certificate
+	certPEM []byte
+}
+
+func newSNSSigner(t *testing.T) *snsSigner {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.us-east-1.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return &snsSigner{
+		key:     key,
+		cert:    cert,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// request returns the request delivering msg, signed with signature
+// version 1.
+func (s *snsSigner) request(t *testing.T, msg *snsMessage) *http.Request {
+	digest := sha1.Sum([]byte(snsStringToSign(msg)))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA1, digest[:])
+	assert.Nil(t, err)
+	msg.SignatureVersion = "1"
+	msg.Signature = base64.StdEncoding.EncodeToString(signature)
+
+	body, err := json.Marshal(msg)
+	assert.Nil(t, err)
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer(body))
+	assert.Nil(t, err)
+	req.Header.Set("X-Amz-Sns-Message-Type", msg.Type)
+	return req
+}
+
+func ccNotification(ref, event string) *snsMessage {
+	return &snsMessage{
+		Type:      "Notification",
+		MessageID: "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+		TopicArn:  snsTopic,
+		Message:   fmt.Sprintf(stateChangeCCBody, event, ref),
+		Timestamp: "2021-04-01T10:00:00.000Z",
+	}
+}
+
+func TestCodeCommitHandle(t *testing.T) {
+	signer := newSNSSigner(t)
+	hc := &HookConf{
+		RefName:    plumbing.ReferenceName("refs/heads/main"),
+		Repository: "https://git-codecommit.us-east-1.amazonaws.com/v1/repos/website",
+	}
+	ccHook := &CodeCommit{Cert: signer.cert, Topics: []string{snsTopic}}
+
+	for i, test := range []struct {
+		msg    *snsMessage
+		code   int
+		commit string
+	}{
+		{ccNotification("refs/heads/main", "referenceUpdated"), http.StatusOK, "4c925148EXAMPLE"},
+		{ccNotification("refs/heads/main", "referenceCreated"), http.StatusOK, "4c925148EXAMPLE"},
+		{ccNotification("refs/heads/main", "referenceDeleted"), http.StatusAccepted, ""},
+		{ccNotification("refs/heads/develop", "referenceUpdated"), http.StatusAccepted, ""},
+		{ccNotification("refs/tags/v1.0.0", "referenceCreated"), http.StatusAccepted, ""},
+		{&snsMessage{Type: "Notification", TopicArn: snsTopic, Message: `{"detail-type": "CodeCommit Pull Request State Change", "region": "us-east-1", "detail": {"repositoryName": "website"}}`}, http.StatusAccepted, ""},
+		{&snsMessage{Type: "UnsubscribeConfirmation", TopicArn: snsTopic}, http.StatusOK, ""},
+	} {
+		req := signer.request(t, test.msg)
+
+		event, code, _ := handle(ccHook, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+		if code == http.StatusOK {
+			assert.Equal(t, test.commit, event.Head, fmt.Sprintf("case %d", i))
+		}
+	}
+
+	// Messages for other repositories are rejected.
+	msg := ccNotification("refs/heads/main", "referenceUpdated")
+	msg.Message = `{"detail-type": "CodeCommit Repository State Change", "region": "us-east-1", "detail": {"repositoryName": "other"}}`
+	_, _, err := handle(ccHook, signer.request(t, msg), hc)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), ErrRepositoryMismatch.Error())
+
+	// The header must tell the type of the message.
+	req := signer.request(t, ccNotification("refs/heads/main", "referenceUpdated"))
+	req.Header.Del("X-Amz-Sns-Message-Type")
+	_, code, _ := handle(ccHook, req, hc)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// The tracked tag is deployed at the commit it was created at.
+	tag := &HookConf{
+		RefName:    plumbing.ReferenceName("refs/tags/v1.0.0"),
+		Repository: hc.Repository,
+	}
+	event, code, _ := handle(ccHook, signer.request(t, ccNotification("refs/tags/v1.0.0", "referenceCreated")), tag)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "4c925148EXAMPLE", event.Head)
+
+	// Messages from other topics are rejected.
+	msg = ccNotification("refs/heads/main", "referenceUpdated")
+	msg.TopicArn = "arn:aws:sns:us-east-1:210987654321:other"
+	_, code, _ = handle(ccHook, signer.request(t, msg), hc)
+	assert.Equal(t, http.StatusForbidden, code)
+	_, code, _ = handle(&CodeCommit{Cert: signer.cert}, signer.request(t, ccNotification("refs/heads/main", "referenceUpdated")), hc)
+	assert.Equal(t, http.StatusForbidden, code)
+}
+
+func TestCodeCommitSignature(t *testing.T) {
+	signer := newSNSSigner(t)
+	other := newSNSSigner(t)
+	hc := &HookConf{RefName: plumbing.ReferenceName("refs/heads/main")}
+
+	// Signed by another certificate.
+	req := other.request(t, ccNotification("refs/heads/main", "referenceUpdated"))
+	_, code, _ := handle(&CodeCommit{Cert: signer.cert, Topics: []string{snsTopic}}, req, hc)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// Tampered after signing.
+	msg := ccNotification("refs/heads/main", "referenceUpdated")
+	signer.request(t, msg)
+	msg.Timestamp = "2021-04-01T11:00:00.000Z"
+	body, err := json.Marshal(msg)
+	assert.Nil(t, err)
+	req, err = http.NewRequest("POST", "/webhook", bytes.NewBuffer(body))
+	assert.Nil(t, err)
+	req.Header.Set("X-Amz-Sns-Message-Type", "Notification")
+	_, code, _ = handle(&CodeCommit{Cert: signer.cert, Topics: []string{snsTopic}}, req, hc)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// Unsigned.
+	req, err = http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(`{"Type": "Notification"}`)))
+	assert.Nil(t, err)
+	req.Header.Set("X-Amz-Sns-Message-Type", "Notification")
+	_, code, _ = handle(&CodeCommit{Cert: signer.cert, Topics: []string{snsTopic}}, req, hc)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestCodeCommitSubscription(t *testing.T) {
+	signer := newSNSSigner(t)
+	hc := &HookConf{RefName: plumbing.ReferenceName("refs/heads/main")}
+
+	// A stand-in SNS confirming subscriptions and serving the
+	// signing certificate.
+	var confirmed, fetched int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/confirm":
+			assert.Equal(t, "token", r.URL.Query().Get("Token"))
+			confirmed++
+		case "/cert.pem":
+			fetched++
+			_, _ = w.Write(signer.certPEM)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ccHook := &CodeCommit{URLs: []string{server.URL}, Topics: []string{snsTopic}}
+
+	confirmation := func(subscribeURL string) *http.Request {
+		return signer.request(t, &snsMessage{
+			Type:           "SubscriptionConfirmation",
+			MessageID:      "165545c9-2a5c-472c-8df2-7ff2be2b3b1b",
+			Token:          "token",
+			TopicArn:       snsTopic,
+			Message:        "You have chosen to subscribe to the topic.",
+			SubscribeURL:   subscribeURL,
+			Timestamp:      "2021-04-01T10:00:00.000Z",
+			SigningCertURL: server.URL + "/cert.pem",
+		})
+	}
+
+	_, code, err := handle(ccHook, confirmation(server.URL+"/confirm?Token=token"), hc)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, confirmed)
+
+	// The certificate is fetched once.
+	_, code, _ = handle(ccHook, confirmation(server.URL+"/confirm?Token=token"), hc)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, confirmed)
+	assert.Equal(t, 1, fetched)
+
+	// Subscribe URLs not allowed are not visited.
+	_, code, _ = handle(ccHook, confirmation("https://attacker.example.com/confirm"), hc)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// Nor are signing certificates fetched from them.
+	ccHook = &CodeCommit{Topics: []string{snsTopic}}
+	_, code, _ = handle(ccHook, confirmation(server.URL+"/confirm?Token=token"), hc)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, 1, fetched)
+	assert.Equal(t, 2, confirmed)
+
+	// Nor are subscriptions to other topics confirmed.
+	ccHook = &CodeCommit{URLs: []string{server.URL}, Topics: []string{"arn:aws:sns:us-east-1:123456789012:other"}}
+	_, code, _ = handle(ccHook, confirmation(server.URL+"/confirm?Token=token"), hc)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, 2, confirmed)
+}
+
+func TestCodeCommitAllowed(t *testing.T) {
+	ccHook := &CodeCommit{}
+
+	for i, test := range []struct {
+		url string
+		ok  bool
+	}{
+		{"https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription", true},
+		{"https://sns.cn-north-1.amazonaws.com.cn/SimpleNotificationService.pem", true},
+		{"http://sns.us-east-1.amazonaws.com/", false},
+		{"https://sns.us-east-1.amazonaws.com.example.com/", false},
+		{"https://example.com/sns.us-east-1.amazonaws.com", false},
+		{"https://sns.bucket.s3.amazonaws.com/cert.pem", false},
+		{"https://sns.US-EAST-1.amazonaws.com/", false},
+		{"not a url", false},
+	} {
+		assert.Equal(t, test.ok, ccHook.allowed(test.url), fmt.Sprintf("case %d", i))
+	}
+
+	// Wildcards of the URLs match a single label.
+	ccHook = &CodeCommit{URLs: []string{"https://sns.*.example.com"}}
+	assert.True(t, ccHook.allowed("https://sns.eu-west-1.example.com/"))
+	assert.False(t, ccHook.allowed("https://sns.bucket.s3.example.com/"))
+}
+
+var stateChangeCCBody = `
+{
+	"version": "0",
+	"id": "01234567-EXAMPLE",
+	"detail-type": "CodeCommit Repository State Change",
+	"source": "aws.codecommit",
+	"account": "123456789012",
+	"time": "2021-04-01T10:00:00Z",
+	"region": "us-east-1",
+	"resources": [
+		"arn:aws:codecommit:us-east-1:123456789012:website"
+	],
+	"detail": {
+		"event": "%s",
+		"repositoryName": "website",
+		"repositoryId": "12345678-1234-5678-abcd-12345678abcd",
+		"referenceType": "branch",
+		"referenceName": "main",
+		"referenceFullName": "%s",
+		"commitId": "4c925148EXAMPLE",
+		"oldCommitId": "3e5983DEXAMPLE"
+	}
+}
+`
@@ -0,0 +1,91 @@
+package webhooks
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// DockerHub handles webhooks of Docker Hub repositories. Docker Hub
+// does not sign webhooks, so the secret is given by the `token` query
+// parameter of the webhook URL.
+type DockerHub struct {
+}
+
+type dhPush struct {
+	PushData struct {
+		Tag string `json:"tag"`
+	} `json:"push_data"`
+	Repository struct {
+		RepoName string `json:"repo_name"`
+	} `json:"repository"`
+}
+
+func (d DockerHub) Handle(r *http.Request, body []byte, hc *HookConf) (*Event, int, error) {
+	err := checkRepository(hc, body, parseDockerHubRepository)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+
+	err = d.handleToken(r, hc.Secret)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+
+	image, err := d.handlePush(body)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+	return &Event{Name: "push", Image: image}, http.StatusOK, nil
+}
+
+// handleToken verifies the `token` query parameter, which is required
+// if the secret is set.
+func (d DockerHub) handleToken(r *http.Request, secret string) error {
+	if secret == "" {
+		return nil
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return unauthorized("query parameter 'token' missing")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return forbidden("invalid token")
+	}
+	return nil
+}
+
+func (d DockerHub) handlePush(body []byte) (*Image, error) {
+	var push dhPush
+
+	err := json.Unmarshal(body, &push)
+	if err != nil {
+		return nil, err
+	}
+
+	if push.Repository.RepoName == "" {
+		return nil, fmt.Errorf("invalid (empty) repository name")
+	}
+	if push.PushData.Tag == "" {
+		return nil, fmt.Errorf("invalid (empty) tag")
+	}
+	return &Image{Name: push.Repository.RepoName, Tag: push.PushData.Tag}, nil
+}
+
+func parseDockerHubRepository(body []byte) (*Repository, error) {
+	var push dhPush
+
+	err := json.Unmarshal(body, &push)
+	if err != nil {
+		return nil, err
+	}
+
+	name := push.Repository.RepoName
+	r := &Repository{FullName: name}
+	if name != "" {
+		r.URLs = []string{"docker.io/" + name}
+	}
+	return r, nil
+}
@@ -0,0 +1,67 @@
+package webhooks
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/alecthomas/assert"
+)
+
+func TestDockerHubHandle(t *testing.T) {
+	dhHook := DockerHub{}
+
+	for i, test := range []struct {
+		url        string
+		secret     string
+		repository string
+		body       string
+		code       int
+		tag        string
+	}{
+		{"/webhook", "", "", pushDHBodyValid, http.StatusOK, "latest"},
+		{"/webhook?token=secret", "secret", "", pushDHBodyValid, http.StatusOK, "latest"},
+		{"/webhook", "secret", "", pushDHBodyValid, http.StatusUnauthorized, ""},
+		{"/webhook?token=wrong", "secret", "", pushDHBodyValid, http.StatusForbidden, ""},
+		{"/webhook", "", "winglim/caddy", pushDHBodyValid, http.StatusOK, "latest"},
+		{"/webhook", "", "docker.io/winglim/caddy", pushDHBodyValid, http.StatusOK, "latest"},
+		{"/webhook", "", "winglim/other", pushDHBodyValid, http.StatusBadRequest, ""},
+		{"/webhook", "", "", `{"repository": {"repo_name": "winglim/caddy"}}`, http.StatusBadRequest, ""},
+		{"/webhook", "", "", "", http.StatusBadRequest, ""},
+	} {
+		hc := &HookConf{
+			Secret:     test.secret,
+			Repository: test.repository,
+		}
+
+		req, err := http.NewRequest("POST", test.url, bytes.NewBuffer([]byte(test.body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+
+		event, code, _ := handle(dhHook, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+		if code == http.StatusOK {
+			assert.Equal(t, "winglim/caddy", event.Image.Name, fmt.Sprintf("case %d", i))
+			assert.Equal(t, test.tag, event.Image.Tag, fmt.Sprintf("case %d", i))
+		}
+	}
+}
+
+var pushDHBodyValid = `
+{
+	"callback_url": "https://registry.hub.docker.com/u/winglim/caddy/hook/2141b5bi5i5b02bec211i4eeih0242eg11000a/",
+	"push_data": {
+		"pushed_at": 1617273600,
+		"pusher": "winglim",
+		"tag": "latest"
+	},
+	"repository": {
+		"name": "caddy",
+		"namespace": "winglim",
+		"repo_name": "winglim/caddy",
+		"repo_url": "https://registry.hub.docker.com/u/winglim/caddy/",
+		"status": "Active"
+	}
+}
+`
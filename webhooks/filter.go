@@ -0,0 +1,105 @@
+package webhooks
+
+import (
+	"path"
+	"strings"
+)
+
+// Commit tells the changes of a pushed commit.
+type Commit struct {
+	ID       string   `json:"id"`
+	Message  string   `json:"message"`
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
+}
+
+// filterPush returns an error if the pushed commits should not be
+// deployed. after is the head commit of the push, and complete tells
+// whether commits lists every pushed commit, since paths can only be
+// checked against a complete list.
+func filterPush(hc *HookConf, after string, commits []Commit, complete bool) error {
+	if len(commits) == 0 {
+		return nil
+	}
+
+	head := commits[len(commits)-1]
+	for _, commit := range commits {
+		if commit.ID == after {
+			head = commit
+			break
+		}
+	}
+
+	for _, marker := range hc.SkipIfMessage {
+		if strings.Contains(head.Message, marker) {
+			return ignore("event: push skipped by message %q", marker)
+		}
+	}
+
+	if !complete || (len(hc.Paths) == 0 && len(hc.PathsIgnore) == 0) {
+		return nil
+	}
+
+	var files []string
+	for _, commit := range commits {
+		files = append(files, commit.Added...)
+		files = append(files, commit.Removed...)
+		files = append(files, commit.Modified...)
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	for _, file := range files {
+		if (len(hc.Paths) == 0 || matchAny(hc.Paths, file)) && !matchAny(hc.PathsIgnore, file) {
+			return nil
+		}
+	}
+	return ignore("event: push skipped, no changed path matched")
+}
+
+// matchAny reports whether name matches any of the patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchPath(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath reports whether the slash separated name matches the
+// pattern. Besides the syntax of path.Match, `**` matches zero or
+// more directories, and a pattern ending with `/` matches everything
+// inside the directory.
+func matchPath(pattern, name string) bool {
+	pattern = strings.TrimPrefix(pattern, "/")
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		matched, err := path.Match(pattern[0], name[0])
+		if err != nil || !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
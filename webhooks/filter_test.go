@@ -0,0 +1,61 @@
+package webhooks
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/alecthomas/assert"
+)
+
+func TestMatchPath(t *testing.T) {
+	for i, test := range []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"docs/**", "docs/index.md", true},
+		{"docs/**", "docs/guide/index.md", true},
+		{"docs/", "docs/guide/index.md", true},
+		{"/docs/", "docs/index.md", true},
+		{"docs/**", "src/docs/index.md", false},
+		{"**/*.md", "README.md", true},
+		{"**/*.md", "docs/guide/index.md", true},
+		{"**/*.md", "main.go", false},
+		{"*.md", "docs/index.md", false},
+		{"src/*/main.go", "src/cmd/main.go", true},
+		{"src/*/main.go", "src/cmd/sub/main.go", false},
+		{"src/**/main.go", "src/cmd/sub/main.go", true},
+	} {
+		assert.Equal(t, test.match, matchPath(test.pattern, test.name), fmt.Sprintf("case %d", i))
+	}
+}
+
+func TestFilterPush(t *testing.T) {
+	commits := []Commit{
+		{ID: "1", Message: "update docs", Modified: []string{"docs/index.md"}},
+		{ID: "2", Message: "fix typo [skip deploy]", Added: []string{"README.md"}},
+	}
+
+	for i, test := range []struct {
+		hc       HookConf
+		after    string
+		complete bool
+		skip     bool
+	}{
+		{HookConf{}, "2", true, false},
+		{HookConf{SkipIfMessage: []string{"[skip deploy]"}}, "2", true, true},
+		{HookConf{SkipIfMessage: []string{"[skip deploy]"}}, "1", true, false},
+		{HookConf{PathsIgnore: []string{"docs/", "*.md"}}, "2", true, true},
+		{HookConf{PathsIgnore: []string{"docs/"}}, "2", true, false},
+		{HookConf{PathsIgnore: []string{"docs/", "*.md"}}, "2", false, false},
+		{HookConf{Paths: []string{"src/**"}}, "2", true, true},
+		{HookConf{Paths: []string{"docs/**"}}, "2", true, false},
+		{HookConf{Paths: []string{"docs/**"}, PathsIgnore: []string{"**/*.md"}}, "2", true, true},
+	} {
+		err := filterPush(&test.hc, test.after, commits, test.complete)
+
+		assert.Equal(t, test.skip, err != nil, fmt.Sprintf("case %d", i))
+	}
+
+	assert.Nil(t, filterPush(&HookConf{Paths: []string{"src/**"}}, "", nil, true))
+}
@@ -0,0 +1,142 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// GHCR handles the package events of GitHub for images pushed to the
+// GitHub Container Registry.
+type GHCR struct {
+}
+
+type ghPackage struct {
+	Name        string `json:"name"`
+	PackageType string `json:"package_type"`
+	Owner       struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+	PackageVersion struct {
+		Version           string `json:"version"`
+		ContainerMetadata struct {
+			Tag struct {
+				Name   string `json:"name"`
+				Digest string `json:"digest"`
+			} `json:"tag"`
+		} `json:"container_metadata"`
+	} `json:"package_version"`
+}
+
+type ghPackageEvent struct {
+	Action string `json:"action"`
+
+	// Package is set by package events, and RegistryPackage by the
+	// registry_package events of GitHub Apps.
+	Package         *ghPackage `json:"package"`
+	RegistryPackage *ghPackage `json:"registry_package"`
+}
+
+func (g GHCR) Handle(r *http.Request, body []byte, hc *HookConf) (*Event, int, error) {
+	event := r.Header.Get("X-Github-Event")
+	if event == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("header 'X-Github-Event' missing")
+	}
+
+	// Ping events are for no package.
+	if event != "ping" {
+		err := checkRepository(hc, body, parseGHCRRepository)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+	}
+
+	err := Github{}.handleSignature(r, body, hc.Secret)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+
+	if !hc.HandlesEvent(event) {
+		return nil, http.StatusAccepted, fmt.Errorf("event: %s, not in events", event)
+	}
+
+	switch event {
+	case "ping":
+		return &Event{Name: event, Ping: true}, http.StatusOK, nil
+	case "package", "registry_package":
+		image, err := g.handlePackage(body)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, Image: image}, http.StatusOK, nil
+	default:
+		return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q event", event)
+	}
+}
+
+func (g GHCR) handlePackage(body []byte) (*Image, error) {
+	var event ghPackageEvent
+
+	err := json.Unmarshal(body, &event)
+	if err != nil {
+		return nil, err
+	}
+
+	if event.Action != "published" {
+		return nil, ignore("event: package %s", event.Action)
+	}
+
+	pkg := event.Package
+	if pkg == nil {
+		pkg = event.RegistryPackage
+	}
+	if pkg == nil || pkg.Name == "" {
+		return nil, fmt.Errorf("invalid (empty) package")
+	}
+	if !strings.EqualFold(pkg.PackageType, "container") {
+		return nil, ignore("event: %s package published", pkg.PackageType)
+	}
+
+	tag := pkg.PackageVersion.ContainerMetadata.Tag
+	if tag.Name == "" {
+		return nil, ignore("event: untagged version %s published", pkg.PackageVersion.Version)
+	}
+
+	digest := tag.Digest
+	if digest == "" {
+		digest = pkg.PackageVersion.Version
+	}
+	return &Image{
+		Name:   ghcrImageName(pkg),
+		Tag:    tag.Name,
+		Digest: digest,
+	}, nil
+}
+
+// ghcrImageName returns the image name of the package, such as
+// ghcr.io/winglim/caddy, which is lowercase.
+func ghcrImageName(pkg *ghPackage) string {
+	return "ghcr.io/" + strings.ToLower(pkg.Owner.Login+"/"+pkg.Name)
+}
+
+func parseGHCRRepository(body []byte) (*Repository, error) {
+	var event ghPackageEvent
+
+	err := json.Unmarshal(body, &event)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg := event.Package
+	if pkg == nil {
+		pkg = event.RegistryPackage
+	}
+	if pkg == nil || pkg.Name == "" {
+		return &Repository{}, nil
+	}
+	return &Repository{
+		FullName: pkg.Owner.Login + "/" + pkg.Name,
+		URLs:     []string{ghcrImageName(pkg)},
+	}, nil
+}
@@ -0,0 +1,95 @@
+package webhooks
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/alecthomas/assert"
+)
+
+func TestGHCRHandle(t *testing.T) {
+	ghcrHook := GHCR{}
+
+	for i, test := range []struct {
+		body       string
+		event      string
+		repository string
+		code       int
+	}{
+		{"", "", "", http.StatusBadRequest},
+		{`{"zen": "Keep it logically awesome."}`, "ping", "winglim/caddy", http.StatusOK},
+		{publishedGHCRBodyValid, "package", "", http.StatusOK},
+		{publishedGHCRBodyValid, "registry_package", "", http.StatusOK},
+		{publishedGHCRBodyValid, "package", "WingLim/caddy", http.StatusOK},
+		{publishedGHCRBodyValid, "package", "ghcr.io/winglim/caddy", http.StatusOK},
+		{publishedGHCRBodyValid, "package", "ghcr.io/winglim/other", http.StatusBadRequest},
+		{publishedGHCRBodyValid, "push", "", http.StatusAccepted},
+		{`{"action": "updated", "package": {"name": "caddy", "package_type": "CONTAINER"}}`, "package", "", http.StatusAccepted},
+		{`{"action": "published", "package": {"name": "caddy", "package_type": "npm"}}`, "package", "", http.StatusAccepted},
+		{`{"action": "published", "package": {"name": "caddy", "package_type": "CONTAINER", "package_version": {"version": "sha256:abc"}}}`, "package", "", http.StatusAccepted},
+	} {
+		hc := &HookConf{Repository: test.repository}
+
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(test.body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		if test.event != "" {
+			req.Header.Add("X-Github-Event", test.event)
+		}
+
+		event, code, _ := handle(ghcrHook, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+		if code == http.StatusOK && test.event != "ping" {
+			assert.Equal(t, "ghcr.io/winglim/caddy", event.Image.Name, fmt.Sprintf("case %d", i))
+			assert.Equal(t, "v2.3.0", event.Image.Tag, fmt.Sprintf("case %d", i))
+			assert.Equal(t, "sha256:1a2b3c4d", event.Image.Digest, fmt.Sprintf("case %d", i))
+		}
+	}
+}
+
+var publishedGHCRBodyValid = `
+{
+	"action": "published",
+	"package": {
+		"id": 123456,
+		"name": "caddy",
+		"namespace": "WingLim",
+		"package_type": "CONTAINER",
+		"owner": {
+			"login": "WingLim"
+		},
+		"package_version": {
+			"id": 654321,
+			"version": "sha256:1a2b3c4d",
+			"container_metadata": {
+				"tag": {
+					"name": "v2.3.0",
+					"digest": "sha256:1a2b3c4d"
+				}
+			},
+			"package_url": "ghcr.io/winglim/caddy:v2.3.0"
+		}
+	},
+	"registry_package": {
+		"id": 123456,
+		"name": "caddy",
+		"namespace": "WingLim",
+		"package_type": "CONTAINER",
+		"owner": {
+			"login": "WingLim"
+		},
+		"package_version": {
+			"id": 654321,
+			"version": "sha256:1a2b3c4d",
+			"container_metadata": {
+				"tag": {
+					"name": "v2.3.0",
+					"digest": "sha256:1a2b3c4d"
+				}
+			}
+		}
+	}
+}
+`
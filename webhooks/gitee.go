@@ -1,9 +1,9 @@
 package webhooks
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 
 	"github.com/go-git/go-git/v5/plumbing"
@@ -13,69 +13,109 @@ type Gitee struct {
 }
 
 type giteePush struct {
-	Ref string `json:"ref"`
+	Ref     string   `json:"ref"`
+	After   string   `json:"after"`
+	Deleted bool     `json:"deleted"`
+	Commits []Commit `json:"commits"`
 }
 
-func (g Gitee) Handle(r *http.Request, hc *HookConf) (int, error) {
+func (g Gitee) Handle(r *http.Request, body []byte, hc *HookConf) (*Event, int, error) {
 
-	body, err := ioutil.ReadAll(r.Body)
+	err := checkRepository(hc, body, parseHubRepository)
 	if err != nil {
-		return http.StatusBadRequest, err
+		return nil, statusCode(err), err
 	}
 
 	err = g.handleToken(r, hc.Secret)
 	if err != nil {
-		return http.StatusBadRequest, err
+		return nil, statusCode(err), err
 	}
 
 	event := r.Header.Get("X-Gitee-Event")
 	if event == "" {
-		return http.StatusBadRequest, fmt.Errorf("header 'X-Gitee-Event' missing")
+		return nil, http.StatusBadRequest, fmt.Errorf("header 'X-Gitee-Event' missing")
+	}
+
+	if !hc.HandlesEvent(event) {
+		return nil, http.StatusAccepted, fmt.Errorf("event: %s, not in events", event)
 	}
 
 	switch event {
 	case "Push Hook":
-		err = g.handlePush(body, hc)
+		commit, err := g.handlePush(body, hc)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, Ref: hc.RefName.String(), Head: commit}, http.StatusOK, nil
+	case "Tag Push Hook":
+		commit, err := g.handleTagPush(body, hc)
 		if err != nil {
-			return http.StatusBadRequest, err
+			return nil, statusCode(err), err
 		}
+		return &Event{Name: event, Ref: hc.RefName.String(), Head: commit}, http.StatusOK, nil
 	default:
-		return http.StatusBadRequest, fmt.Errorf("cannot handle %q event", event)
+		return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q event", event)
 	}
-
-	return http.StatusOK, nil
 }
 
 func (g Gitee) handleToken(r *http.Request, secret string) error {
 	token := r.Header.Get("X-Gitee-Token")
-	if token != "" {
-		if secret == "" {
-			return fmt.Errorf("empty webhook secret")
-		} else {
-			if token != secret {
-				return fmt.Errorf("inavlid token")
-			}
+	if token == "" {
+		if secret != "" {
+			return unauthorized("header 'X-Gitee-Token' missing")
 		}
+		return nil
+	}
+	if secret == "" {
+		return forbidden("empty webhook secret")
 	}
 
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return forbidden("invalid token")
+	}
 	return nil
 }
 
-func (g Gitee) handlePush(body []byte, hc *HookConf) error {
+func (g Gitee) handlePush(body []byte, hc *HookConf) (string, error) {
 	var push giteePush
 
 	err := json.Unmarshal(body, &push)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	refName := plumbing.ReferenceName(push.Ref)
-	if refName.IsBranch() {
-		if refName != hc.RefName {
-			return fmt.Errorf("event: push to branch %s", refName)
-		}
-	} else {
-		return fmt.Errorf("refName is not a branch: %s", refName)
+	if !refName.IsBranch() {
+		return "", ignore("refName is not a branch: %s", refName)
 	}
-	return nil
+	if refName != hc.RefName {
+		return "", ignore("event: push to branch %s", refName)
+	}
+	err = filterPush(hc, push.After, push.Commits, true)
+	if err != nil {
+		return "", err
+	}
+	return push.After, nil
+}
+
+// handleTagPush returns the commit the tracked tag was pushed to.
+func (g Gitee) handleTagPush(body []byte, hc *HookConf) (string, error) {
+	var push giteePush
+
+	err := json.Unmarshal(body, &push)
+	if err != nil {
+		return "", err
+	}
+
+	refName := plumbing.ReferenceName(push.Ref)
+	if !refName.IsTag() {
+		return "", ignore("refName is not a tag: %s", refName)
+	}
+	if push.Deleted || push.After == plumbing.ZeroHash.String() {
+		return "", ignore("event: delete tag %s", refName.Short())
+	}
+	if refName != hc.RefName {
+		return "", ignore("event: push to tag %s", refName.Short())
+	}
+	return push.After, nil
 }
@@ -25,6 +25,9 @@ func TestGiteeHandle(t *testing.T) {
 		{"", "Push Hook", http.StatusBadRequest},
 		{`{"ref": "refs/heads/main"}`, "Push Hook", http.StatusOK},
 		{`{"ref": "refs/heads/others}"`, "Push Hook", http.StatusBadRequest},
+		{`{"ref": "refs/tags/v1.0.0", "after": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}`, "Tag Push Hook", http.StatusAccepted},
+		{`{"ref": "refs/tags/v1.0.0", "deleted": true}`, "Tag Push Hook", http.StatusAccepted},
+		{`{"ref": "refs/heads/main"}`, "Tag Push Hook", http.StatusAccepted},
 	} {
 		req, err := http.NewRequest("POST", "", bytes.NewBuffer([]byte(test.body)))
 		assert.Nil(t, err, fmt.Sprintf("case %d", i))
@@ -33,8 +36,63 @@ func TestGiteeHandle(t *testing.T) {
 			req.Header.Add("X-Gitee-Event", test.event)
 		}
 
-		code, _ := glHook.Handle(req, hc)
+		_, code, _ := handle(glHook, req, hc)
 
 		assert.Equal(t, code, test.code, fmt.Sprintf("case %d", i))
 	}
 }
+
+func TestGiteeTag(t *testing.T) {
+	hook := Gitee{}
+	body := `{"ref": "refs/tags/v1.0.0", "after": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}`
+
+	for i, test := range []struct {
+		refName string
+		code    int
+		commit  string
+	}{
+		{"refs/tags/v1.0.0", http.StatusOK, "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"},
+		{"refs/tags/v2.0.0", http.StatusAccepted, ""},
+	} {
+		hc := &HookConf{RefName: plumbing.ReferenceName(test.refName)}
+		req, err := http.NewRequest("POST", "", bytes.NewBuffer([]byte(body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.Header.Add("X-Gitee-Event", "Tag Push Hook")
+
+		event, code, _ := handle(hook, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+		if code == http.StatusOK {
+			assert.Equal(t, test.commit, event.Head, fmt.Sprintf("case %d", i))
+		}
+	}
+}
+
+func TestGiteeSecret(t *testing.T) {
+	for i, test := range []struct {
+		secret string
+		token  string
+		code   int
+	}{
+		{"", "", http.StatusOK},
+		{"secret", "secret", http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "wrong", http.StatusForbidden},
+		{"", "secret", http.StatusForbidden},
+	} {
+		hc := &HookConf{
+			Secret:  test.secret,
+			RefName: plumbing.ReferenceName("refs/heads/main"),
+		}
+
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(`{"ref": "refs/heads/main"}`)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.Header.Add("X-Gitee-Event", "Push Hook")
+		if test.token != "" {
+			req.Header.Add("X-Gitee-Token", test.token)
+		}
+
+		_, code, _ := handle(Gitee{}, req, hc)
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+	}
+}
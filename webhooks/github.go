@@ -6,8 +6,8 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/go-git/go-git/v5/plumbing"
 )
@@ -16,7 +16,39 @@ type Github struct {
 }
 
 type ghPush struct {
-	Ref string `json:"ref"`
+	Ref     string   `json:"ref"`
+	After   string   `json:"after"`
+	Deleted bool     `json:"deleted"`
+	Commits []Commit `json:"commits"`
+}
+
+type ghPullRequest struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Head struct {
+			Repo *struct {
+				ID int64 `json:"id"`
+			} `json:"repo"`
+		} `json:"head"`
+		Base struct {
+			Repo struct {
+				ID int64 `json:"id"`
+			} `json:"repo"`
+		} `json:"base"`
+	} `json:"pull_request"`
+}
+
+type ghWorkflowRun struct {
+	Action      string `json:"action"`
+	WorkflowRun struct {
+		Name       string `json:"name"`
+		Path       string `json:"path"`
+		Event      string `json:"event"`
+		Conclusion string `json:"conclusion"`
+		HeadBranch string `json:"head_branch"`
+		HeadSha    string `json:"head_sha"`
+	} `json:"workflow_run"`
 }
 
 type ghRelease struct {
@@ -26,73 +58,119 @@ type ghRelease struct {
 	} `json:"release"`
 }
 
-func (g Github) Handle(r *http.Request, hc *HookConf) (int, error) {
-	body, err := ioutil.ReadAll(r.Body)
+func (g Github) Handle(r *http.Request, body []byte, hc *HookConf) (*Event, int, error) {
+	err := checkRepository(hc, body, parseHubRepository)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+
 	err = g.handleSignature(r, body, hc.Secret)
 	if err != nil {
-		return http.StatusBadRequest, err
+		return nil, statusCode(err), err
 	}
 
 	event := r.Header.Get("X-Github-Event")
 	if event == "" {
-		return http.StatusBadRequest, fmt.Errorf("header 'X-Github-Event' missing")
+		return nil, http.StatusBadRequest, fmt.Errorf("header 'X-Github-Event' missing")
+	}
+
+	if !hc.HandlesEvent(event) {
+		return nil, http.StatusAccepted, fmt.Errorf("event: %s, not in events", event)
 	}
 
 	switch event {
 	case "ping":
+		return &Event{Name: event, Ping: true}, http.StatusOK, nil
 	case "push":
-		err = g.handlePush(body, hc)
+		if hc.Trigger == TriggerCI {
+			return nil, http.StatusAccepted, fmt.Errorf("event: push, waiting for ci")
+		}
+		commit, err := g.handlePush(body, hc)
 		if err != nil {
-			return http.StatusBadRequest, err
+			return nil, statusCode(err), err
 		}
+		return &Event{Name: event, Ref: hc.RefName.String(), Head: commit}, http.StatusOK, nil
 	case "release":
 		err = g.handleRelease(body, hc)
 		if err != nil {
-			return http.StatusBadRequest, err
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, Ref: hc.RefName.String()}, http.StatusOK, nil
+	case "workflow_run":
+		if hc.Trigger != TriggerCI {
+			return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q event", event)
+		}
+		commit, err := g.handleWorkflowRun(body, hc)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, Ref: hc.RefName.String(), Commit: commit}, http.StatusOK, nil
+	case "pull_request":
+		if !hc.Previews {
+			return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q event", event)
 		}
+		pr, err := g.handlePullRequest(body, hc)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, PullRequest: pr}, http.StatusOK, nil
 	default:
-		return http.StatusBadRequest, fmt.Errorf("cannot handle %q event", event)
+		return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q event", event)
 	}
-
-	return http.StatusOK, nil
 }
 
 func (g Github) handleSignature(r *http.Request, body []byte, secret string) error {
 	signature := r.Header.Get("X-Hub-Signature")
-	if signature != "" {
-		if secret == "" {
-			return fmt.Errorf("empty webhook secret")
-		} else {
-			mac := hmac.New(sha1.New, []byte(secret))
-			mac.Write(body)
-			expectedMac := hex.EncodeToString(mac.Sum(nil))
-
-			if signature[5:] != expectedMac {
-				return fmt.Errorf("inavlid signature")
-			}
+	if signature == "" {
+		if secret != "" {
+			return unauthorized("header 'X-Hub-Signature' missing")
 		}
+		return nil
+	}
+	if secret == "" {
+		return forbidden("empty webhook secret")
 	}
+	if !strings.HasPrefix(signature, "sha1=") {
+		return forbidden("invalid signature")
+	}
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write(body)
+	expectedMac := hex.EncodeToString(mac.Sum(nil))
 
+	if !hmac.Equal([]byte(signature[len("sha1="):]), []byte(expectedMac)) {
+		return forbidden("invalid signature")
+	}
 	return nil
 }
 
-func (g Github) handlePush(body []byte, hc *HookConf) error {
+// handlePush returns the commit the tracked tag was pushed to, or
+// empty for the tracked branch.
+func (g Github) handlePush(body []byte, hc *HookConf) (string, error) {
 	var push ghPush
 
 	err := json.Unmarshal(body, &push)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	refName := plumbing.ReferenceName(push.Ref)
+	if !refName.IsBranch() && !refName.IsTag() {
+		return "", ignore("refName is neither a branch nor a tag: %s", refName)
+	}
+	if refName != hc.RefName {
+		return "", ignore("event: push to %s", refName)
+	}
+	if push.Deleted {
+		return "", ignore("event: delete %s", refName)
+	}
 	if refName.IsBranch() {
-		if refName != hc.RefName {
-			return fmt.Errorf("event: push to branch %s", refName)
+		err = filterPush(hc, push.After, push.Commits, true)
+		if err != nil {
+			return "", err
 		}
-	} else {
-		return fmt.Errorf("refName is not a branch: %s", refName)
 	}
-	return nil
+	return push.After, nil
 }
 
 func (g Github) handleRelease(body []byte, hc *HookConf) error {
@@ -105,6 +183,73 @@ func (g Github) handleRelease(body []byte, hc *HookConf) error {
 	if release.Release.TagName == "" {
 		return fmt.Errorf("invalid (empty) tag name")
 	}
+	if plumbing.NewTagReferenceName(release.Release.TagName) != hc.RefName {
+		return ignore("event: release of tag %s", release.Release.TagName)
+	}
 
 	return nil
 }
+
+func (g Github) handlePullRequest(body []byte, hc *HookConf) (*PullRequest, error) {
+	var pull ghPullRequest
+
+	err := json.Unmarshal(body, &pull)
+	if err != nil {
+		return nil, err
+	}
+	if pull.Number == 0 {
+		return nil, fmt.Errorf("invalid (empty) pull request number")
+	}
+
+	pr := &PullRequest{
+		Number: pull.Number,
+		Ref:    plumbing.ReferenceName(fmt.Sprintf("refs/pull/%d/head", pull.Number)),
+	}
+	switch pull.Action {
+	case "opened", "reopened", "synchronize":
+	case "closed":
+		pr.Closed = true
+	default:
+		return nil, ignore("event: pull request %s", pull.Action)
+	}
+
+	// The head repository is null once the fork is deleted.
+	head, base := pull.PullRequest.Head.Repo, pull.PullRequest.Base.Repo
+	fork := head == nil || head.ID != base.ID
+	if err := checkFork(pr, fork, hc); err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+func (g Github) handleWorkflowRun(body []byte, hc *HookConf) (string, error) {
+	var run ghWorkflowRun
+
+	err := json.Unmarshal(body, &run)
+	if err != nil {
+		return "", err
+	}
+
+	if run.Action != "completed" {
+		return "", ignore("event: workflow run %s", run.Action)
+	}
+	// Other workflows, such as lint, may pass before the one
+	// telling the commit is deployable.
+	if hc.Workflow != run.WorkflowRun.Name && hc.Workflow != run.WorkflowRun.Path {
+		return "", ignore("event: run of workflow %s", run.WorkflowRun.Name)
+	}
+	if run.WorkflowRun.Conclusion != "success" {
+		return "", ignore("event: workflow run %s", run.WorkflowRun.Conclusion)
+	}
+	if strings.HasPrefix(run.WorkflowRun.Event, "pull_request") {
+		return "", ignore("event: workflow run for %s", run.WorkflowRun.Event)
+	}
+	if run.WorkflowRun.HeadBranch != hc.RefName.Short() {
+		return "", ignore("event: workflow run on branch %s", run.WorkflowRun.HeadBranch)
+	}
+	if run.WorkflowRun.HeadSha == "" {
+		return "", fmt.Errorf("invalid (empty) head sha")
+	}
+
+	return run.WorkflowRun.HeadSha, nil
+}
@@ -2,6 +2,9 @@ package webhooks
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"testing"
@@ -12,7 +15,9 @@ import (
 
 func TestGithubHandle(t *testing.T) {
 	hc := &HookConf{
-		RefName: plumbing.ReferenceName("refs/heads/main"),
+		RefName:       plumbing.ReferenceName("refs/heads/main"),
+		SkipIfMessage: []string{"[skip deploy]"},
+		PathsIgnore:   []string{"docs/"},
 	}
 	ghHook := Github{}
 
@@ -25,6 +30,9 @@ func TestGithubHandle(t *testing.T) {
 		{"", "push", http.StatusBadRequest},
 		{`{"ref": "refs/heads/main"}`, "push", http.StatusOK},
 		{`{"ref": "refs/heads/others}"`, "push", http.StatusBadRequest},
+		{pushGHBodyDocs, "push", http.StatusAccepted},
+		{pushGHBodySkip, "push", http.StatusAccepted},
+		{pushGHBodySource, "push", http.StatusOK},
 	} {
 		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(test.body)))
 		assert.Nil(t, err, fmt.Sprintf("case %d", i))
@@ -33,8 +41,269 @@ func TestGithubHandle(t *testing.T) {
 			req.Header.Add("X-Github-Event", test.event)
 		}
 
-		code, _ := ghHook.Handle(req, hc)
+		_, code, _ := handle(ghHook, req, hc)
 
 		assert.Equal(t, code, test.code, fmt.Sprintf("case %d", i))
 	}
 }
+
+func TestGithubPullRequest(t *testing.T) {
+	hc := &HookConf{
+		RefName:  plumbing.ReferenceName("refs/heads/main"),
+		Previews: true,
+	}
+	ghHook := Github{}
+
+	for i, test := range []struct {
+		body   string
+		code   int
+		number int
+		closed bool
+	}{
+		{`{"action": "opened", "number": 1, "pull_request": {"head": {"repo": {"id": 1}}, "base": {"repo": {"id": 1}}}}`, http.StatusOK, 1, false},
+		{`{"action": "synchronize", "number": 1, "pull_request": {"head": {"repo": {"id": 1}}, "base": {"repo": {"id": 1}}}}`, http.StatusOK, 1, false},
+		{`{"action": "closed", "number": 1, "pull_request": {"head": {"repo": {"id": 1}}, "base": {"repo": {"id": 1}}}}`, http.StatusOK, 1, true},
+		{`{"action": "opened", "number": 1, "pull_request": {"head": {"repo": {"id": 2}}, "base": {"repo": {"id": 1}}}}`, http.StatusAccepted, 0, false},
+		{`{"action": "opened", "number": 1, "pull_request": {"head": {"repo": null}, "base": {"repo": {"id": 1}}}}`, http.StatusAccepted, 0, false},
+		{`{"action": "closed", "number": 1, "pull_request": {"head": {"repo": {"id": 2}}, "base": {"repo": {"id": 1}}}}`, http.StatusOK, 1, true},
+		{`{"action": "labeled", "number": 1}`, http.StatusAccepted, 0, false},
+		{`{"action": "opened"}`, http.StatusBadRequest, 0, false},
+	} {
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(test.body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+
+		req.Header.Add("X-Github-Event", "pull_request")
+
+		event, code, _ := handle(ghHook, req, hc)
+
+		assert.Equal(t, code, test.code, fmt.Sprintf("case %d", i))
+		if test.code == http.StatusOK {
+			assert.Equal(t, test.number, event.PullRequest.Number, fmt.Sprintf("case %d", i))
+			assert.Equal(t, plumbing.ReferenceName("refs/pull/1/head"), event.PullRequest.Ref, fmt.Sprintf("case %d", i))
+			assert.Equal(t, test.closed, event.PullRequest.Closed, fmt.Sprintf("case %d", i))
+		}
+	}
+
+	hc.PreviewForks = true
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(`{"action": "opened", "number": 1, "pull_request": {"head": {"repo": {"id": 2}}, "base": {"repo": {"id": 1}}}}`)))
+	assert.Nil(t, err)
+	req.Header.Add("X-Github-Event", "pull_request")
+
+	event, code, _ := handle(ghHook, req, hc)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, event.PullRequest.Number)
+
+	hc.Previews = false
+	req, err = http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(`{"action": "opened", "number": 1, "pull_request": {"head": {"repo": {"id": 1}}, "base": {"repo": {"id": 1}}}}`)))
+	assert.Nil(t, err)
+	req.Header.Add("X-Github-Event", "pull_request")
+
+	_, code, _ = handle(ghHook, req, hc)
+	assert.Equal(t, http.StatusAccepted, code)
+}
+
+func TestGithubWorkflowRun(t *testing.T) {
+	hc := &HookConf{
+		RefName:  plumbing.ReferenceName("refs/heads/main"),
+		Trigger:  TriggerCI,
+		Workflow: "test",
+	}
+	ghHook := Github{}
+
+	for i, test := range []struct {
+		body   string
+		event  string
+		code   int
+		commit string
+	}{
+		{`{"ref": "refs/heads/main"}`, "push", http.StatusAccepted, ""},
+		{`{"action": "completed", "workflow_run": {"name": "test", "path": ".github/workflows/test.yml", "event": "push", "conclusion": "success", "head_branch": "main", "head_sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}}`, "workflow_run", http.StatusOK, "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"},
+		{`{"action": "requested", "workflow_run": {"name": "test", "path": ".github/workflows/test.yml", "event": "push", "head_branch": "main", "head_sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}}`, "workflow_run", http.StatusAccepted, ""},
+		{`{"action": "completed", "workflow_run": {"name": "test", "path": ".github/workflows/test.yml", "event": "push", "conclusion": "failure", "head_branch": "main", "head_sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}}`, "workflow_run", http.StatusAccepted, ""},
+		{`{"action": "completed", "workflow_run": {"name": "test", "path": ".github/workflows/test.yml", "event": "pull_request", "conclusion": "success", "head_branch": "main", "head_sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}}`, "workflow_run", http.StatusAccepted, ""},
+		{`{"action": "completed", "workflow_run": {"name": "lint", "path": ".github/workflows/lint.yml", "event": "push", "conclusion": "success", "head_branch": "main", "head_sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}}`, "workflow_run", http.StatusAccepted, ""},
+		{`{"action": "completed", "workflow_run": {"name": "test", "path": ".github/workflows/test.yml", "event": "push", "conclusion": "success", "head_branch": "others", "head_sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}}`, "workflow_run", http.StatusAccepted, ""},
+	} {
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(test.body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+
+		req.Header.Add("X-Github-Event", test.event)
+
+		event, code, _ := handle(ghHook, req, hc)
+
+		assert.Equal(t, code, test.code, fmt.Sprintf("case %d", i))
+		if test.code == http.StatusOK {
+			assert.Equal(t, test.commit, event.Commit, fmt.Sprintf("case %d", i))
+		}
+	}
+
+	// The workflow may be given by its path.
+	hc.Workflow = ".github/workflows/test.yml"
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(`{"action": "completed", "workflow_run": {"name": "test", "path": ".github/workflows/test.yml", "event": "push", "conclusion": "success", "head_branch": "main", "head_sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}}`)))
+	assert.Nil(t, err)
+	req.Header.Add("X-Github-Event", "workflow_run")
+
+	_, code, _ := handle(ghHook, req, hc)
+	assert.Equal(t, http.StatusOK, code)
+
+	hc.Trigger = TriggerPush
+	req, err = http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(`{"action": "completed", "workflow_run": {"name": "test", "path": ".github/workflows/test.yml", "event": "push", "conclusion": "success", "head_branch": "main", "head_sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}}`)))
+	assert.Nil(t, err)
+	req.Header.Add("X-Github-Event", "workflow_run")
+
+	_, code, _ = handle(ghHook, req, hc)
+	assert.Equal(t, http.StatusAccepted, code)
+}
+
+var pushGHBodyDocs = `
+{
+	"ref": "refs/heads/main",
+	"after": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7",
+	"commits": [
+		{
+			"id": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7",
+			"message": "update docs",
+			"added": [],
+			"removed": [],
+			"modified": ["docs/index.md"]
+		}
+	]
+}
+`
+
+var pushGHBodySkip = `
+{
+	"ref": "refs/heads/main",
+	"after": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7",
+	"commits": [
+		{
+			"id": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7",
+			"message": "fix typo [skip deploy]",
+			"added": [],
+			"removed": [],
+			"modified": ["main.go"]
+		}
+	]
+}
+`
+
+var pushGHBodySource = `
+{
+	"ref": "refs/heads/main",
+	"after": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7",
+	"commits": [
+		{
+			"id": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7",
+			"message": "update site",
+			"added": [],
+			"removed": [],
+			"modified": ["docs/index.md", "main.go"]
+		}
+	]
+}
+`
+
+func TestGithubEvents(t *testing.T) {
+	hc := &HookConf{
+		RefName: plumbing.ReferenceName("refs/tags/v1.0.0"),
+		Events:  []string{"release"},
+	}
+	ghHook := Github{}
+
+	for i, test := range []struct {
+		body  string
+		event string
+		code  int
+	}{
+		{`{"ref": "refs/heads/main"}`, "push", http.StatusAccepted},
+		{`{"action": "published", "release": {"tag_name": "v1.0.0"}}`, "release", http.StatusOK},
+		{`{"action": "starred"}`, "star", http.StatusAccepted},
+	} {
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(test.body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.Header.Add("X-Github-Event", test.event)
+
+		_, code, _ := handle(ghHook, req, hc)
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+	}
+}
+
+func TestGithubTag(t *testing.T) {
+	ghHook := Github{}
+	body := `{"ref": "refs/tags/v1.0.0", "after": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}`
+
+	for i, test := range []struct {
+		refName string
+		code    int
+		commit  string
+	}{
+		{"refs/tags/v1.0.0", http.StatusOK, "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"},
+		{"refs/tags/v2.0.0", http.StatusAccepted, ""},
+		{"refs/heads/main", http.StatusAccepted, ""},
+	} {
+		hc := &HookConf{RefName: plumbing.ReferenceName(test.refName)}
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.Header.Add("X-Github-Event", "push")
+
+		event, code, _ := handle(ghHook, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+		if code == http.StatusOK {
+			assert.Equal(t, test.commit, event.Head, fmt.Sprintf("case %d", i))
+		}
+	}
+}
+
+func TestGithubPushHead(t *testing.T) {
+	hc := &HookConf{RefName: plumbing.NewBranchReferenceName("main")}
+	body := `{"ref": "refs/heads/main", "after": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}`
+
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(body)))
+	assert.Nil(t, err)
+	req.Header.Add("X-Github-Event", "push")
+
+	// A branch push updates to the latest commit, so a redelivered
+	// push never moves the branch back.
+	event, code, err := handle(Github{}, req, hc)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "", event.Commit)
+	assert.Equal(t, "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7", event.Head)
+}
+
+func TestGithubSecret(t *testing.T) {
+	body := `{"ref": "refs/heads/main"}`
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write([]byte(body))
+	signature := "sha1=" + hex.EncodeToString(mac.Sum(nil))
+
+	for i, test := range []struct {
+		secret    string
+		signature string
+		code      int
+	}{
+		{"", "", http.StatusOK},
+		{"secret", signature, http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "sha1=0123", http.StatusForbidden},
+		{"secret", "sha", http.StatusForbidden},
+		{"secret", signature[len("sha1="):], http.StatusForbidden},
+		{"", signature, http.StatusForbidden},
+	} {
+		hc := &HookConf{
+			Secret:  test.secret,
+			RefName: plumbing.ReferenceName("refs/heads/main"),
+		}
+
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.Header.Add("X-Github-Event", "push")
+		if test.signature != "" {
+			req.Header.Add("X-Hub-Signature", test.signature)
+		}
+
+		_, code, _ := handle(Github{}, req, hc)
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+	}
+}
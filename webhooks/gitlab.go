@@ -1,9 +1,9 @@
 package webhooks
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 
 	"github.com/go-git/go-git/v5/plumbing"
@@ -13,68 +13,231 @@ type Gitlab struct {
 }
 
 type glPush struct {
-	Ref string `json:"ref"`
+	Ref               string   `json:"ref"`
+	After             string   `json:"after"`
+	TotalCommitsCount int      `json:"total_commits_count"`
+	Commits           []Commit `json:"commits"`
 }
 
-func (g Gitlab) Handle(r *http.Request, hc *HookConf) (int, error) {
-	body, err := ioutil.ReadAll(r.Body)
+type glMergeRequest struct {
+	ObjectAttributes struct {
+		IID             int    `json:"iid"`
+		Action          string `json:"action"`
+		SourceProjectID int64  `json:"source_project_id"`
+		TargetProjectID int64  `json:"target_project_id"`
+	} `json:"object_attributes"`
+}
+
+type glPipeline struct {
+	ObjectAttributes struct {
+		Ref    string `json:"ref"`
+		Tag    bool   `json:"tag"`
+		Sha    string `json:"sha"`
+		Status string `json:"status"`
+		Source string `json:"source"`
+	} `json:"object_attributes"`
+}
+
+type glProject struct {
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		GitHTTPURL        string `json:"git_http_url"`
+		GitSSHURL         string `json:"git_ssh_url"`
+		WebURL            string `json:"web_url"`
+	} `json:"project"`
+}
+
+func (g Gitlab) Handle(r *http.Request, body []byte, hc *HookConf) (*Event, int, error) {
+	err := checkRepository(hc, body, parseGitlabRepository)
 	if err != nil {
-		return http.StatusBadRequest, err
+		return nil, statusCode(err), err
 	}
 
 	err = g.handleToken(r, hc.Secret)
 	if err != nil {
-		return http.StatusBadRequest, err
+		return nil, statusCode(err), err
 	}
 
 	event := r.Header.Get("X-Gitlab-Event")
 	if event == "" {
-		return http.StatusBadRequest, fmt.Errorf("header 'X-Gitlab-Event' missing")
+		return nil, http.StatusBadRequest, fmt.Errorf("header 'X-Gitlab-Event' missing")
+	}
+
+	if !hc.HandlesEvent(event) {
+		return nil, http.StatusAccepted, fmt.Errorf("event: %s, not in events", event)
 	}
 
 	switch event {
 	case "Push Hook":
-		err = g.handlePush(body, hc)
+		if hc.Trigger == TriggerCI {
+			return nil, http.StatusAccepted, fmt.Errorf("event: push, waiting for ci")
+		}
+		commit, err := g.handlePush(body, hc)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, Ref: hc.RefName.String(), Head: commit}, http.StatusOK, nil
+	case "Tag Push Hook":
+		commit, err := g.handleTagPush(body, hc)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, Ref: hc.RefName.String(), Head: commit}, http.StatusOK, nil
+	case "Pipeline Hook":
+		if hc.Trigger != TriggerCI {
+			return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q event", event)
+		}
+		commit, err := g.handlePipeline(body, hc)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, Ref: hc.RefName.String(), Commit: commit}, http.StatusOK, nil
+	case "Merge Request Hook":
+		if !hc.Previews {
+			return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q event", event)
+		}
+		pr, err := g.handleMergeRequest(body, hc)
 		if err != nil {
-			return http.StatusBadRequest, err
+			return nil, statusCode(err), err
 		}
+		return &Event{Name: event, PullRequest: pr}, http.StatusOK, nil
 	default:
-		return http.StatusBadRequest, fmt.Errorf("cannot handle %q event", event)
+		return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q event", event)
 	}
-
-	return http.StatusOK, nil
 }
 
 func (g Gitlab) handleToken(r *http.Request, secret string) error {
 	token := r.Header.Get("X-Gitlab-Token")
-	if token != "" {
-		if secret == "" {
-			return fmt.Errorf("empty webhook secret")
-		} else {
-			if token != secret {
-				return fmt.Errorf("inavlid token")
-			}
+	if token == "" {
+		if secret != "" {
+			return unauthorized("header 'X-Gitlab-Token' missing")
 		}
+		return nil
+	}
+	if secret == "" {
+		return forbidden("empty webhook secret")
 	}
 
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return forbidden("invalid token")
+	}
 	return nil
 }
 
-func (g Gitlab) handlePush(body []byte, hc *HookConf) error {
+func (g Gitlab) handlePush(body []byte, hc *HookConf) (string, error) {
 	var push glPush
 
 	err := json.Unmarshal(body, &push)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	refName := plumbing.ReferenceName(push.Ref)
-	if refName.IsBranch() {
-		if refName != hc.RefName {
-			return fmt.Errorf("event: push to branch %s", refName)
-		}
-	} else {
-		return fmt.Errorf("refName is not a branch: %s", refName)
+	if !refName.IsBranch() {
+		return "", ignore("refName is not a branch: %s", refName)
 	}
-	return nil
+	if refName != hc.RefName {
+		return "", ignore("event: push to branch %s", refName)
+	}
+
+	complete := push.TotalCommitsCount <= len(push.Commits)
+	err = filterPush(hc, push.After, push.Commits, complete)
+	if err != nil {
+		return "", err
+	}
+	return push.After, nil
+}
+
+// handleTagPush returns the commit the tracked tag was pushed to.
+func (g Gitlab) handleTagPush(body []byte, hc *HookConf) (string, error) {
+	var push glPush
+
+	err := json.Unmarshal(body, &push)
+	if err != nil {
+		return "", err
+	}
+
+	refName := plumbing.ReferenceName(push.Ref)
+	if !refName.IsTag() {
+		return "", ignore("refName is not a tag: %s", refName)
+	}
+	if push.After == plumbing.ZeroHash.String() {
+		return "", ignore("event: delete tag %s", refName.Short())
+	}
+	if refName != hc.RefName {
+		return "", ignore("event: push to tag %s", refName.Short())
+	}
+	return push.After, nil
+}
+
+func (g Gitlab) handleMergeRequest(body []byte, hc *HookConf) (*PullRequest, error) {
+	var merge glMergeRequest
+
+	err := json.Unmarshal(body, &merge)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := merge.ObjectAttributes
+	if attrs.IID == 0 {
+		return nil, fmt.Errorf("invalid (empty) merge request iid")
+	}
+
+	pr := &PullRequest{
+		Number: attrs.IID,
+		Ref:    plumbing.ReferenceName(fmt.Sprintf("refs/merge-requests/%d/head", attrs.IID)),
+	}
+	switch attrs.Action {
+	case "open", "reopen", "update":
+	case "close", "merge":
+		pr.Closed = true
+	default:
+		return nil, ignore("event: merge request %s", attrs.Action)
+	}
+
+	fork := attrs.SourceProjectID == 0 || attrs.SourceProjectID != attrs.TargetProjectID
+	if err := checkFork(pr, fork, hc); err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+func (g Gitlab) handlePipeline(body []byte, hc *HookConf) (string, error) {
+	var pipeline glPipeline
+
+	err := json.Unmarshal(body, &pipeline)
+	if err != nil {
+		return "", err
+	}
+
+	attrs := pipeline.ObjectAttributes
+	if attrs.Status != "success" {
+		return "", ignore("event: pipeline %s", attrs.Status)
+	}
+	if attrs.Source == "merge_request_event" {
+		return "", ignore("event: pipeline for %s", attrs.Source)
+	}
+	if attrs.Tag || attrs.Ref != hc.RefName.Short() {
+		return "", ignore("event: pipeline on ref %s", attrs.Ref)
+	}
+	if attrs.Sha == "" {
+		return "", fmt.Errorf("invalid (empty) sha")
+	}
+
+	return attrs.Sha, nil
+}
+
+func parseGitlabRepository(body []byte) (*Repository, error) {
+	var payload glProject
+
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	project := payload.Project
+	return &Repository{
+		FullName: project.PathWithNamespace,
+		URLs:     []string{project.GitHTTPURL, project.GitSSHURL, project.WebURL},
+	}, nil
 }
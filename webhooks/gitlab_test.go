@@ -25,6 +25,10 @@ func TestGitlabHandle(t *testing.T) {
 		{"", "Push Hook", http.StatusBadRequest},
 		{`{"ref": "refs/heads/main"}`, "Push Hook", http.StatusOK},
 		{`{"ref": "refs/heads/others}"`, "Push Hook", http.StatusBadRequest},
+		{`{"ref": "refs/tags/v1.0.0"}`, "Push Hook", http.StatusAccepted},
+		{`{"ref": "refs/tags/v1.0.0", "after": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}`, "Tag Push Hook", http.StatusAccepted},
+		{`{"ref": "refs/tags/v1.0.0", "after": "0000000000000000000000000000000000000000"}`, "Tag Push Hook", http.StatusAccepted},
+		{`{"ref": "refs/heads/main"}`, "Tag Push Hook", http.StatusAccepted},
 	} {
 		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(test.body)))
 		assert.Nil(t, err, fmt.Sprintf("case %d", i))
@@ -33,8 +37,159 @@ func TestGitlabHandle(t *testing.T) {
 			req.Header.Add("X-Gitlab-Event", test.event)
 		}
 
-		code, _ := glHook.Handle(req, hc)
+		_, code, _ := handle(glHook, req, hc)
 
 		assert.Equal(t, code, test.code, fmt.Sprintf("case %d", i))
 	}
 }
+
+func TestGitlabPullRequest(t *testing.T) {
+	hc := &HookConf{
+		RefName:  plumbing.ReferenceName("refs/heads/main"),
+		Previews: true,
+	}
+	glHook := Gitlab{}
+
+	for i, test := range []struct {
+		body   string
+		code   int
+		number int
+		closed bool
+	}{
+		{`{"object_attributes": {"action": "open", "iid": 1, "source_project_id": 1, "target_project_id": 1}}`, http.StatusOK, 1, false},
+		{`{"object_attributes": {"action": "update", "iid": 1, "source_project_id": 1, "target_project_id": 1}}`, http.StatusOK, 1, false},
+		{`{"object_attributes": {"action": "merge", "iid": 1, "source_project_id": 1, "target_project_id": 1}}`, http.StatusOK, 1, true},
+		{`{"object_attributes": {"action": "open", "iid": 1, "source_project_id": 2, "target_project_id": 1}}`, http.StatusAccepted, 0, false},
+		{`{"object_attributes": {"action": "close", "iid": 1, "source_project_id": 2, "target_project_id": 1}}`, http.StatusOK, 1, true},
+		{`{"object_attributes": {"action": "approved", "iid": 1}}`, http.StatusAccepted, 0, false},
+		{`{"object_attributes": {"action": "open"}}`, http.StatusBadRequest, 0, false},
+	} {
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(test.body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+
+		req.Header.Add("X-Gitlab-Event", "Merge Request Hook")
+
+		event, code, _ := handle(glHook, req, hc)
+
+		assert.Equal(t, code, test.code, fmt.Sprintf("case %d", i))
+		if test.code == http.StatusOK {
+			assert.Equal(t, test.number, event.PullRequest.Number, fmt.Sprintf("case %d", i))
+			assert.Equal(t, plumbing.ReferenceName("refs/merge-requests/1/head"), event.PullRequest.Ref, fmt.Sprintf("case %d", i))
+			assert.Equal(t, test.closed, event.PullRequest.Closed, fmt.Sprintf("case %d", i))
+		}
+	}
+
+	hc.PreviewForks = true
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(`{"object_attributes": {"action": "open", "iid": 1, "source_project_id": 2, "target_project_id": 1}}`)))
+	assert.Nil(t, err)
+	req.Header.Add("X-Gitlab-Event", "Merge Request Hook")
+
+	event, code, _ := handle(glHook, req, hc)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, event.PullRequest.Number)
+
+	hc.Previews = false
+	req, err = http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(`{"object_attributes": {"action": "open", "iid": 1, "source_project_id": 1, "target_project_id": 1}}`)))
+	assert.Nil(t, err)
+	req.Header.Add("X-Gitlab-Event", "Merge Request Hook")
+
+	_, code, _ = handle(glHook, req, hc)
+	assert.Equal(t, http.StatusAccepted, code)
+}
+
+func TestGitlabPipeline(t *testing.T) {
+	hc := &HookConf{
+		RefName: plumbing.ReferenceName("refs/heads/main"),
+		Trigger: TriggerCI,
+	}
+	glHook := Gitlab{}
+
+	for i, test := range []struct {
+		body   string
+		event  string
+		code   int
+		commit string
+	}{
+		{`{"ref": "refs/heads/main"}`, "Push Hook", http.StatusAccepted, ""},
+		{`{"object_attributes": {"ref": "main", "tag": false, "sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7", "status": "success", "source": "push"}}`, "Pipeline Hook", http.StatusOK, "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"},
+		{`{"object_attributes": {"ref": "main", "tag": false, "sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7", "status": "failed", "source": "push"}}`, "Pipeline Hook", http.StatusAccepted, ""},
+		{`{"object_attributes": {"ref": "main", "tag": false, "sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7", "status": "success", "source": "merge_request_event"}}`, "Pipeline Hook", http.StatusAccepted, ""},
+		{`{"object_attributes": {"ref": "main", "tag": true, "sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7", "status": "success", "source": "push"}}`, "Pipeline Hook", http.StatusAccepted, ""},
+		{`{"object_attributes": {"ref": "others", "tag": false, "sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7", "status": "success", "source": "push"}}`, "Pipeline Hook", http.StatusAccepted, ""},
+	} {
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(test.body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+
+		req.Header.Add("X-Gitlab-Event", test.event)
+
+		event, code, _ := handle(glHook, req, hc)
+
+		assert.Equal(t, code, test.code, fmt.Sprintf("case %d", i))
+		if test.code == http.StatusOK {
+			assert.Equal(t, test.commit, event.Commit, fmt.Sprintf("case %d", i))
+		}
+	}
+
+	hc.Trigger = TriggerPush
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(`{"object_attributes": {"ref": "main", "tag": false, "sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7", "status": "success", "source": "push"}}`)))
+	assert.Nil(t, err)
+	req.Header.Add("X-Gitlab-Event", "Pipeline Hook")
+
+	_, code, _ := handle(glHook, req, hc)
+	assert.Equal(t, http.StatusAccepted, code)
+}
+
+func TestGitlabTag(t *testing.T) {
+	hook := Gitlab{}
+	body := `{"ref": "refs/tags/v1.0.0", "after": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}`
+
+	for i, test := range []struct {
+		refName string
+		code    int
+		commit  string
+	}{
+		{"refs/tags/v1.0.0", http.StatusOK, "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"},
+		{"refs/tags/v2.0.0", http.StatusAccepted, ""},
+	} {
+		hc := &HookConf{RefName: plumbing.ReferenceName(test.refName)}
+		req, err := http.NewRequest("POST", "", bytes.NewBuffer([]byte(body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.Header.Add("X-Gitlab-Event", "Tag Push Hook")
+
+		event, code, _ := handle(hook, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+		if code == http.StatusOK {
+			assert.Equal(t, test.commit, event.Head, fmt.Sprintf("case %d", i))
+		}
+	}
+}
+
+func TestGitlabSecret(t *testing.T) {
+	for i, test := range []struct {
+		secret string
+		token  string
+		code   int
+	}{
+		{"", "", http.StatusOK},
+		{"secret", "secret", http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "wrong", http.StatusForbidden},
+		{"", "secret", http.StatusForbidden},
+	} {
+		hc := &HookConf{
+			Secret:  test.secret,
+			RefName: plumbing.ReferenceName("refs/heads/main"),
+		}
+
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(`{"ref": "refs/heads/main"}`)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.Header.Add("X-Gitlab-Event", "Push Hook")
+		if test.token != "" {
+			req.Header.Add("X-Gitlab-Token", test.token)
+		}
+
+		_, code, _ := handle(Gitlab{}, req, hc)
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+	}
+}
@@ -0,0 +1,140 @@
+package webhooks
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// gitReceiveMaxAge is how old the timestamp of a git-receive request
+// may be, either way to allow for clock skew.
+const gitReceiveMaxAge = 5 * time.Minute
+
+// GitReceive handles requests of the post-receive hook of a plain git
+// server, whose body is the `<oldrev> <newrev> <refname>` lines the
+// hook reads. The optional X-Git-Repository header tells the name or
+// URL of the repository. The X-Hub-Signature header signs the
+// X-Git-Timestamp header, the repository and the body, and requests
+// are accepted once, while the timestamp is recent.
+type GitReceive struct {
+	nonces nonceCache
+}
+
+func (g *GitReceive) Handle(r *http.Request, body []byte, hc *HookConf) (*Event, int, error) {
+	// The repository is only checked if the hook tells it.
+	if repo := r.Header.Get("X-Git-Repository"); repo != "" {
+		err := checkRepository(hc, []byte(repo), parseGitReceiveRepository)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+	}
+
+	// Requests are not verified by anything else.
+	if hc.Secret == "" {
+		return nil, http.StatusForbidden, fmt.Errorf("empty webhook secret")
+	}
+	err := g.handleSignature(r, body, hc.Secret)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+
+	commit, err := g.handleReceive(body, hc)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+	return &Event{Name: "post-receive", Ref: hc.RefName.String(), Head: commit}, http.StatusOK, nil
+}
+
+// handleSignature verifies the X-Hub-Signature header, the HMAC-SHA256
+// of the X-Git-Timestamp and X-Git-Repository headers and the body, one
+// per line. Stale timestamps and replayed signatures are rejected.
+func (g *GitReceive) handleSignature(r *http.Request, body []byte, secret string) error {
+	signature := r.Header.Get("X-Hub-Signature")
+	if signature == "" {
+		return unauthorized("header 'X-Hub-Signature' missing")
+	}
+	header := r.Header.Get("X-Git-Timestamp")
+	if header == "" {
+		return unauthorized("header 'X-Git-Timestamp' missing")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(header + "\n" + r.Header.Get("X-Git-Repository") + "\n"))
+	mac.Write(body)
+	expectedMac := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(signature), []byte(expectedMac)) {
+		return forbidden("invalid signature")
+	}
+
+	timestamp, err := strconv.ParseInt(header, 10, 64)
+	if err != nil {
+		return forbidden("invalid timestamp %q", header)
+	}
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > gitReceiveMaxAge || age < -gitReceiveMaxAge {
+		return forbidden("stale timestamp %s", header)
+	}
+
+	if !g.nonces.add(signature) {
+		return forbidden("replayed request")
+	}
+	return nil
+}
+
+// handleReceive returns the commit the tracked ref was pushed to.
+func (g *GitReceive) handleReceive(body []byte, hc *HookConf) (string, error) {
+	var first string
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return "", fmt.Errorf("invalid line %q, want `<oldrev> <newrev> <refname>`", line)
+		}
+		newRev, refName := fields[1], plumbing.ReferenceName(fields[2])
+		if first == "" {
+			first = refName.String()
+		}
+
+		deleted := strings.Trim(newRev, "0") == ""
+		if refName == hc.RefName {
+			if deleted {
+				return "", ignore("event: delete %s", refName)
+			}
+			return newRev, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	if first == "" {
+		return "", fmt.Errorf("the push was incomplete, missing refs")
+	}
+	return "", ignore("event: push to %s", first)
+}
+
+// parseGitReceiveRepository parses the repository told by the
+// X-Git-Repository header, either a full name or an URL.
+func parseGitReceiveRepository(header []byte) (*Repository, error) {
+	repo := strings.TrimSpace(string(header))
+	if isRepositoryURL(repo) {
+		return &Repository{URLs: []string{repo}}, nil
+	}
+	return &Repository{FullName: strings.TrimSuffix(repo, ".git")}, nil
+}
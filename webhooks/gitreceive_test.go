@@ -0,0 +1,161 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func signGitReceive(timestamp, repo, body string) string {
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(timestamp + "\n" + repo + "\n" + body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// gitReceiveRequest returns the request the post-receive hook sends
+// for the body and repository, signed now.
+func gitReceiveRequest(t *testing.T, body, repo string) *http.Request {
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(body)))
+	assert.Nil(t, err)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Add("X-Git-Timestamp", timestamp)
+	req.Header.Add("X-Hub-Signature", signGitReceive(timestamp, repo, body))
+	if repo != "" {
+		req.Header.Add("X-Git-Repository", repo)
+	}
+	return req
+}
+
+func TestGitReceiveHandle(t *testing.T) {
+	hc := &HookConf{
+		Secret:  "secret",
+		RefName: plumbing.ReferenceName("refs/heads/main"),
+	}
+	grHook := &GitReceive{}
+
+	for i, test := range []struct {
+		body   string
+		code   int
+		commit string
+	}{
+		{"", http.StatusBadRequest, ""},
+		{receiveBodyValid, http.StatusOK, "9f3c2b1a0e4d5c6b7a8f9e0d1c2b3a4f5e6d7c8b"},
+		{receiveBodyValid + "\n\n", http.StatusOK, "9f3c2b1a0e4d5c6b7a8f9e0d1c2b3a4f5e6d7c8b"},
+		{"1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b 9f3c2b1a0e4d5c6b7a8f9e0d1c2b3a4f5e6d7c8b refs/heads/develop\n", http.StatusAccepted, ""},
+		{"1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b 0000000000000000000000000000000000000000 refs/heads/main\n", http.StatusAccepted, ""},
+		{"0000000000000000000000000000000000000000 9f3c2b1a0e4d5c6b7a8f9e0d1c2b3a4f5e6d7c8b refs/tags/v1.0.0\n", http.StatusAccepted, ""},
+		{"refs/heads/main\n", http.StatusBadRequest, ""},
+	} {
+		event, code, _ := handle(grHook, gitReceiveRequest(t, test.body, ""), hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+		if code == http.StatusOK {
+			assert.Equal(t, test.commit, event.Head, fmt.Sprintf("case %d", i))
+		}
+	}
+
+	// The tracked tag is deployed at the commit it was pushed to.
+	tag := &HookConf{
+		Secret:  "secret",
+		RefName: plumbing.ReferenceName("refs/tags/v1.0.0"),
+	}
+	body := "0000000000000000000000000000000000000000 9f3c2b1a0e4d5c6b7a8f9e0d1c2b3a4f5e6d7c8b refs/tags/v1.0.0\n"
+	event, code, _ := handle(&GitReceive{}, gitReceiveRequest(t, body, ""), tag)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "9f3c2b1a0e4d5c6b7a8f9e0d1c2b3a4f5e6d7c8b", event.Head)
+}
+
+func TestGitReceiveSignature(t *testing.T) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	for i, test := range []struct {
+		secret    string
+		timestamp string
+		signature string
+		code      int
+	}{
+		{"secret", now, signGitReceive(now, "", receiveBodyValid), http.StatusOK},
+		{"secret", now, "", http.StatusUnauthorized},
+		{"secret", "", signGitReceive("", "", receiveBodyValid), http.StatusUnauthorized},
+		{"secret", now, "sha256=0123", http.StatusForbidden},
+		{"secret", now, signGitReceive(now, "team/blog", receiveBodyValid), http.StatusForbidden},
+		{"secret", stale, signGitReceive(stale, "", receiveBodyValid), http.StatusForbidden},
+		{"secret", "now", signGitReceive("now", "", receiveBodyValid), http.StatusForbidden},
+		{"", "", "", http.StatusForbidden},
+		{"", now, signGitReceive(now, "", receiveBodyValid), http.StatusForbidden},
+	} {
+		hc := &HookConf{
+			Secret:  test.secret,
+			RefName: plumbing.ReferenceName("refs/heads/main"),
+		}
+
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(receiveBodyValid)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		if test.timestamp != "" {
+			req.Header.Add("X-Git-Timestamp", test.timestamp)
+		}
+		if test.signature != "" {
+			req.Header.Add("X-Hub-Signature", test.signature)
+		}
+
+		_, code, _ := handle(&GitReceive{}, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+	}
+
+	// Replayed requests are rejected.
+	hc := &HookConf{
+		Secret:  "secret",
+		RefName: plumbing.ReferenceName("refs/heads/main"),
+	}
+	grHook := &GitReceive{}
+	req := gitReceiveRequest(t, receiveBodyValid, "")
+	replay, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(receiveBodyValid)))
+	assert.Nil(t, err)
+	replay.Header = req.Header.Clone()
+
+	_, code, _ := handle(grHook, req, hc)
+	assert.Equal(t, http.StatusOK, code)
+	_, code, _ = handle(grHook, replay, hc)
+	assert.Equal(t, http.StatusForbidden, code)
+}
+
+func TestGitReceiveRepository(t *testing.T) {
+	for i, test := range []struct {
+		header string
+		code   int
+	}{
+		{"", http.StatusOK},
+		{"team/blog", http.StatusOK},
+		{"team/blog.git", http.StatusOK},
+		{"git@git.example.com:team/blog.git", http.StatusOK},
+		{"ssh://git@git.example.com/team/blog.git", http.StatusOK},
+		{"team/docs", http.StatusBadRequest},
+		{"git@git.example.com:team/docs.git", http.StatusBadRequest},
+	} {
+		hc := &HookConf{
+			Secret:     "secret",
+			Repository: "git@git.example.com:team/blog.git",
+			RefName:    plumbing.ReferenceName("refs/heads/main"),
+		}
+
+		_, code, _ := handle(&GitReceive{}, gitReceiveRequest(t, receiveBodyValid, test.header), hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+	}
+}
+
+var receiveBodyValid = `0000000000000000000000000000000000000000 4b3c2e1d5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c refs/tags/v1.0.0
+1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b 9f3c2b1a0e4d5c6b7a8f9e0d1c2b3a4f5e6d7c8b refs/heads/main
+`
@@ -1,88 +1,328 @@
 package webhooks
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/go-git/go-git/v5/plumbing"
 )
 
+// gogsAPITimeout is the timeout to get the combined status of a
+// commit.
+const gogsAPITimeout = 10 * time.Second
+
 type Gogs struct {
+	// APIURL is the API URL of the repository, such as
+	// `https://gitea.example.com/api/v1/repos/owner/name`, to get the
+	// combined status of commits from. It is configured rather than
+	// taken from events, since the token is sent to it.
+	APIURL string
+
+	// Client to get the combined status of commits with.
+	// Default to http.DefaultClient.
+	Client *http.Client
 }
 
 type gogsPush struct {
-	Ref string `json:"ref"`
+	Ref     string   `json:"ref"`
+	After   string   `json:"after"`
+	Commits []Commit `json:"commits"`
+}
+
+type gogsPullRequest struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		// Gitea tells the repositories in the head and base, and
+		// Gogs besides them.
+		Head struct {
+			RepoID int64 `json:"repo_id"`
+		} `json:"head"`
+		Base struct {
+			RepoID int64 `json:"repo_id"`
+		} `json:"base"`
+		HeadRepo *struct {
+			ID int64 `json:"id"`
+		} `json:"head_repo"`
+		BaseRepo *struct {
+			ID int64 `json:"id"`
+		} `json:"base_repo"`
+	} `json:"pull_request"`
 }
 
-func (g Gogs) Handle(r *http.Request, hc *HookConf) (int, error) {
+type gogsStatus struct {
+	Sha      string `json:"sha"`
+	State    string `json:"state"`
+	Branches []struct {
+		Name string `json:"name"`
+	} `json:"branches"`
+}
 
-	body, err := ioutil.ReadAll(r.Body)
+type gogsCombinedStatus struct {
+	State string `json:"state"`
+}
+
+type gogsCreate struct {
+	Ref     string `json:"ref"`
+	RefType string `json:"ref_type"`
+	Sha     string `json:"sha"`
+}
+
+func (g Gogs) Handle(r *http.Request, body []byte, hc *HookConf) (*Event, int, error) {
+
+	err := checkRepository(hc, body, parseHubRepository)
 	if err != nil {
-		return http.StatusBadRequest, err
+		return nil, statusCode(err), err
 	}
 
 	err = g.handleSignature(r, body, hc.Secret)
 	if err != nil {
-		return http.StatusBadRequest, err
+		return nil, statusCode(err), err
 	}
 
 	event := r.Header.Get("X-Gogs-Event")
 	if event == "" {
-		return http.StatusBadRequest, fmt.Errorf("header 'X-Gogs-Event' missing")
+		return nil, http.StatusBadRequest, fmt.Errorf("header 'X-Gogs-Event' missing")
+	}
+
+	if !hc.HandlesEvent(event) {
+		return nil, http.StatusAccepted, fmt.Errorf("event: %s, not in events", event)
 	}
 
 	switch event {
 	case "push":
-		err = g.handlePush(body, hc)
+		if hc.Trigger == TriggerCI {
+			return nil, http.StatusAccepted, fmt.Errorf("event: push, waiting for ci")
+		}
+		commit, err := g.handlePush(body, hc)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, Ref: hc.RefName.String(), Head: commit}, http.StatusOK, nil
+	case "create":
+		commit, err := g.handleCreate(body, hc)
 		if err != nil {
-			return http.StatusBadRequest, err
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, Ref: hc.RefName.String(), Head: commit}, http.StatusOK, nil
+	case "status":
+		if hc.Trigger != TriggerCI {
+			return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q event", event)
 		}
+		commit, err := g.handleStatus(r.Context(), body, hc)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, Ref: hc.RefName.String(), Commit: commit}, http.StatusOK, nil
+	case "pull_request":
+		if !hc.Previews {
+			return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q event", event)
+		}
+		pr, err := g.handlePullRequest(body, hc)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, PullRequest: pr}, http.StatusOK, nil
 	default:
-		return http.StatusBadRequest, fmt.Errorf("cannot handle %q event", event)
+		return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q event", event)
 	}
-
-	return http.StatusOK, nil
 }
 
 func (g Gogs) handleSignature(r *http.Request, body []byte, secret string) error {
 	signature := r.Header.Get("X-Gogs-Signature")
-	if signature != "" {
-		if secret == "" {
-			return fmt.Errorf("empty webhook secret")
-		} else {
-			mac := hmac.New(sha256.New, []byte(secret))
-			mac.Write(body)
-			expectedMac := hex.EncodeToString(mac.Sum(nil))
-
-			if signature != expectedMac {
-				return fmt.Errorf("inavlid signature")
-			}
+	if signature == "" {
+		if secret != "" {
+			return unauthorized("header 'X-Gogs-Signature' missing")
 		}
+		return nil
 	}
+	if secret == "" {
+		return forbidden("empty webhook secret")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expectedMac := hex.EncodeToString(mac.Sum(nil))
 
+	if !hmac.Equal([]byte(signature), []byte(expectedMac)) {
+		return forbidden("invalid signature")
+	}
 	return nil
 }
 
-func (g Gogs) handlePush(body []byte, hc *HookConf) error {
+// handlePush returns the commit the tracked tag was pushed to, or
+// empty for the tracked branch.
+func (g Gogs) handlePush(body []byte, hc *HookConf) (string, error) {
 	var push gogsPush
 
 	err := json.Unmarshal(body, &push)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	refName := plumbing.ReferenceName(push.Ref)
 	if refName.IsBranch() {
 		if refName != hc.RefName {
-			return fmt.Errorf("event: push to branch %s", refName)
+			return "", ignore("event: push to branch %s", refName)
 		}
-	} else {
-		return fmt.Errorf("refName is not a branch: %s", refName)
+		err = filterPush(hc, push.After, push.Commits, true)
+		if err != nil {
+			return "", err
+		}
+		return push.After, nil
+	} else if !refName.IsTag() {
+		return "", ignore("refName is neither a branch nor a tag: %s", refName)
 	}
-	return nil
+	if refName != hc.RefName {
+		return "", ignore("event: push to tag %s", refName.Short())
+	}
+	return push.After, nil
+}
+
+// handleCreate returns the commit the tracked tag was created at.
+func (g Gogs) handleCreate(body []byte, hc *HookConf) (string, error) {
+	var create gogsCreate
+
+	err := json.Unmarshal(body, &create)
+	if err != nil {
+		return "", err
+	}
+
+	if create.RefType != "tag" {
+		return "", ignore("event: create %s %s", create.RefType, create.Ref)
+	}
+	if create.Ref == "" {
+		return "", fmt.Errorf("invalid (empty) tag name")
+	}
+	if plumbing.NewTagReferenceName(create.Ref) != hc.RefName {
+		return "", ignore("event: create tag %s", create.Ref)
+	}
+	return create.Sha, nil
+}
+
+func (g Gogs) handlePullRequest(body []byte, hc *HookConf) (*PullRequest, error) {
+	var pull gogsPullRequest
+
+	err := json.Unmarshal(body, &pull)
+	if err != nil {
+		return nil, err
+	}
+	if pull.Number == 0 {
+		return nil, fmt.Errorf("invalid (empty) pull request number")
+	}
+
+	pr := &PullRequest{
+		Number: pull.Number,
+		Ref:    plumbing.ReferenceName(fmt.Sprintf("refs/pull/%d/head", pull.Number)),
+	}
+	switch pull.Action {
+	case "opened", "reopened", "synchronized":
+	case "closed":
+		pr.Closed = true
+	default:
+		return nil, ignore("event: pull request %s", pull.Action)
+	}
+
+	if err := checkFork(pr, gogsFork(&pull), hc); err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+// gogsFork reports whether the pull request is from another repository
+// than its base, or tells no repositories.
+func gogsFork(pull *gogsPullRequest) bool {
+	p := pull.PullRequest
+	head, base := p.Head.RepoID, p.Base.RepoID
+	if p.HeadRepo != nil && p.BaseRepo != nil {
+		head, base = p.HeadRepo.ID, p.BaseRepo.ID
+	}
+	return head == 0 || head != base
+}
+
+// handleStatus returns the commit of the status once all the statuses
+// of the commit succeeded, since Gitea sends an event for each of them.
+func (g Gogs) handleStatus(ctx context.Context, body []byte, hc *HookConf) (string, error) {
+	var status gogsStatus
+
+	err := json.Unmarshal(body, &status)
+	if err != nil {
+		return "", err
+	}
+
+	if status.State != "success" {
+		return "", ignore("event: status %s", status.State)
+	}
+	if status.Sha == "" {
+		return "", fmt.Errorf("invalid (empty) sha")
+	}
+	if _, err := hex.DecodeString(status.Sha); err != nil {
+		return "", fmt.Errorf("invalid sha %q", status.Sha)
+	}
+
+	onBranch := false
+	for _, branch := range status.Branches {
+		if branch.Name == hc.RefName.Short() {
+			onBranch = true
+			break
+		}
+	}
+	if !onBranch {
+		return "", ignore("event: status of commit %s not on branch %s", status.Sha, hc.RefName.Short())
+	}
+
+	state, err := g.combinedStatus(ctx, status.Sha, hc.Token)
+	if err != nil {
+		return "", err
+	}
+	if state != "success" {
+		return "", ignore("event: combined status %s", state)
+	}
+	return status.Sha, nil
+}
+
+// combinedStatus returns the combined state of the statuses of the
+// commit, from the API URL of the repository.
+func (g Gogs) combinedStatus(ctx context.Context, sha, token string) (string, error) {
+	if g.APIURL == "" {
+		return "", fmt.Errorf("no api url to get the combined status of %s from", sha)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, gogsAPITimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.APIURL+"/commits/"+sha+"/status", nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "token "+token)
+	}
+
+	client := g.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", &StatusError{Code: http.StatusBadGateway, Err: fmt.Errorf("getting combined status of %s: %v", sha, err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", &StatusError{Code: http.StatusBadGateway, Err: fmt.Errorf("getting combined status of %s: HTTP %d", sha, resp.StatusCode)}
+	}
+
+	var combined gogsCombinedStatus
+	err = json.NewDecoder(resp.Body).Decode(&combined)
+	if err != nil {
+		return "", &StatusError{Code: http.StatusBadGateway, Err: fmt.Errorf("getting combined status of %s: %v", sha, err)}
+	}
+	return combined.State, nil
 }
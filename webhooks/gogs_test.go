@@ -2,8 +2,12 @@ package webhooks
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/alecthomas/assert"
@@ -25,6 +29,10 @@ func TestGogsHandle(t *testing.T) {
 		{"", "push", http.StatusBadRequest},
 		{`{"ref": "refs/heads/main"}`, "push", http.StatusOK},
 		{`{"ref": "refs/heads/others}"`, "push", http.StatusBadRequest},
+		{`{"ref": "refs/tags/v1.0.0"}`, "push", http.StatusAccepted},
+		{`{"ref": "refs/pull/1/head"}`, "push", http.StatusAccepted},
+		{`{"ref": "v1.0.0", "ref_type": "tag"}`, "create", http.StatusAccepted},
+		{`{"ref": "feature", "ref_type": "branch"}`, "create", http.StatusAccepted},
 	} {
 		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(test.body)))
 		assert.Nil(t, err, fmt.Sprintf("case %d", i))
@@ -33,12 +41,41 @@ func TestGogsHandle(t *testing.T) {
 			req.Header.Add("X-Gogs-Event", test.event)
 		}
 
-		code, _ := ggHook.Handle(req, hc)
+		_, code, _ := handle(ggHook, req, hc)
 
 		assert.Equal(t, code, test.code, fmt.Sprintf("case %d", i))
 	}
 }
 
+func TestGogsTag(t *testing.T) {
+	ggHook := Gogs{}
+
+	for i, test := range []struct {
+		refName string
+		body    string
+		event   string
+		code    int
+		commit  string
+	}{
+		{"refs/tags/v1.0.0", `{"ref": "refs/tags/v1.0.0", "after": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}`, "push", http.StatusOK, "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"},
+		{"refs/tags/v2.0.0", `{"ref": "refs/tags/v1.0.0", "after": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}`, "push", http.StatusAccepted, ""},
+		{"refs/tags/v1.0.0", `{"ref": "v1.0.0", "ref_type": "tag", "sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}`, "create", http.StatusOK, "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"},
+		{"refs/tags/v2.0.0", `{"ref": "v1.0.0", "ref_type": "tag", "sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"}`, "create", http.StatusAccepted, ""},
+	} {
+		hc := &HookConf{RefName: plumbing.ReferenceName(test.refName)}
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(test.body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.Header.Add("X-Gogs-Event", test.event)
+
+		event, code, _ := handle(ggHook, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+		if code == http.StatusOK {
+			assert.Equal(t, test.commit, event.Head, fmt.Sprintf("case %d", i))
+		}
+	}
+}
+
 func TestHandleSignature(t *testing.T) {
 	req, err := http.NewRequest("", "", bytes.NewBuffer([]byte(signatureBody)))
 	assert.Nil(t, err)
@@ -117,3 +154,165 @@ var signatureBody = `{
     "username": "etienne.fachaux"
   }
 }`
+
+func TestGogsPullRequest(t *testing.T) {
+	hc := &HookConf{
+		RefName:  plumbing.ReferenceName("refs/heads/main"),
+		Previews: true,
+	}
+	ggHook := Gogs{}
+
+	for i, test := range []struct {
+		body   string
+		code   int
+		number int
+		closed bool
+	}{
+		{`{"action": "opened", "number": 1, "pull_request": {"head_repo": {"id": 1}, "base_repo": {"id": 1}}}`, http.StatusOK, 1, false},
+		{`{"action": "synchronized", "number": 1, "pull_request": {"head": {"repo_id": 1}, "base": {"repo_id": 1}}}`, http.StatusOK, 1, false},
+		{`{"action": "closed", "number": 1, "pull_request": {"head_repo": {"id": 1}, "base_repo": {"id": 1}}}`, http.StatusOK, 1, true},
+		{`{"action": "opened", "number": 1, "pull_request": {"head_repo": {"id": 2}, "base_repo": {"id": 1}}}`, http.StatusAccepted, 0, false},
+		{`{"action": "opened", "number": 1, "pull_request": {"head": {"repo_id": 2}, "base": {"repo_id": 1}}}`, http.StatusAccepted, 0, false},
+		{`{"action": "opened", "number": 1}`, http.StatusAccepted, 0, false},
+		{`{"action": "closed", "number": 1, "pull_request": {"head_repo": {"id": 2}, "base_repo": {"id": 1}}}`, http.StatusOK, 1, true},
+		{`{"action": "label_updated", "number": 1}`, http.StatusAccepted, 0, false},
+		{`{"action": "opened"}`, http.StatusBadRequest, 0, false},
+	} {
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(test.body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+
+		req.Header.Add("X-Gogs-Event", "pull_request")
+
+		event, code, _ := handle(ggHook, req, hc)
+
+		assert.Equal(t, code, test.code, fmt.Sprintf("case %d", i))
+		if test.code == http.StatusOK {
+			assert.Equal(t, test.number, event.PullRequest.Number, fmt.Sprintf("case %d", i))
+			assert.Equal(t, plumbing.ReferenceName("refs/pull/1/head"), event.PullRequest.Ref, fmt.Sprintf("case %d", i))
+			assert.Equal(t, test.closed, event.PullRequest.Closed, fmt.Sprintf("case %d", i))
+		}
+	}
+
+	hc.PreviewForks = true
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(`{"action": "opened", "number": 1, "pull_request": {"head": {"repo_id": 2}, "base": {"repo_id": 1}}}`)))
+	assert.Nil(t, err)
+	req.Header.Add("X-Gogs-Event", "pull_request")
+
+	event, code, _ := handle(ggHook, req, hc)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, event.PullRequest.Number)
+
+	hc.Previews = false
+	req, err = http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(`{"action": "opened", "number": 1, "pull_request": {"head_repo": {"id": 1}, "base_repo": {"id": 1}}}`)))
+	assert.Nil(t, err)
+	req.Header.Add("X-Gogs-Event", "pull_request")
+
+	_, code, _ = handle(ggHook, req, hc)
+	assert.Equal(t, http.StatusAccepted, code)
+}
+
+func TestGogsStatus(t *testing.T) {
+	// A stand-in Gitea API with the combined status of commits.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "token api-token", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/repos/winglim/site/commits/82b3d5ae55f7080f1e6022629cdb57bfae7cccc7/status":
+			_, _ = w.Write([]byte(`{"state": "success"}`))
+		case "/repos/winglim/site/commits/3bbc1d8d3d4d1e9f8b0f5f5a0e4e0d5b6c7a8b9c/status":
+			_, _ = w.Write([]byte(`{"state": "pending"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	hc := &HookConf{
+		RefName: plumbing.ReferenceName("refs/heads/main"),
+		Trigger: TriggerCI,
+		Token:   "api-token",
+	}
+	ggHook := Gogs{APIURL: server.URL + "/repos/winglim/site"}
+
+	// The API URL told by the event is not trusted with the token.
+	status := func(sha, state, branch string) string {
+		return fmt.Sprintf(`{"sha": %q, "state": %q, "branches": [{"name": %q}], "repository": {"url": "https://attacker.example.com/api/v1/repos/winglim/site"}}`, sha, state, branch)
+	}
+
+	for i, test := range []struct {
+		body   string
+		event  string
+		code   int
+		commit string
+	}{
+		{`{"ref": "refs/heads/main"}`, "push", http.StatusAccepted, ""},
+		{status("82b3d5ae55f7080f1e6022629cdb57bfae7cccc7", "success", "main"), "status", http.StatusOK, "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7"},
+		{status("82b3d5ae55f7080f1e6022629cdb57bfae7cccc7", "pending", "main"), "status", http.StatusAccepted, ""},
+		{status("82b3d5ae55f7080f1e6022629cdb57bfae7cccc7", "success", "others"), "status", http.StatusAccepted, ""},
+		{status("3bbc1d8d3d4d1e9f8b0f5f5a0e4e0d5b6c7a8b9c", "success", "main"), "status", http.StatusAccepted, ""},
+		{status("0123", "success", "main"), "status", http.StatusBadGateway, ""},
+		{status("../../other", "success", "main"), "status", http.StatusBadRequest, ""},
+		{`{"state": "success", "branches": [{"name": "main"}]}`, "status", http.StatusBadRequest, ""},
+	} {
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(test.body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+
+		req.Header.Add("X-Gogs-Event", test.event)
+
+		event, code, _ := handle(ggHook, req, hc)
+
+		assert.Equal(t, code, test.code, fmt.Sprintf("case %d", i))
+		if test.code == http.StatusOK {
+			assert.Equal(t, test.commit, event.Commit, fmt.Sprintf("case %d", i))
+		}
+	}
+
+	// Without API URL, the combined status cannot be checked.
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(status("82b3d5ae55f7080f1e6022629cdb57bfae7cccc7", "success", "main"))))
+	assert.Nil(t, err)
+	req.Header.Add("X-Gogs-Event", "status")
+
+	_, _, err = handle(Gogs{}, req, hc)
+	assert.NotNil(t, err)
+
+	hc.Trigger = TriggerPush
+	req, err = http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(status("82b3d5ae55f7080f1e6022629cdb57bfae7cccc7", "success", "main"))))
+	assert.Nil(t, err)
+	req.Header.Add("X-Gogs-Event", "status")
+
+	_, code, _ := handle(ggHook, req, hc)
+	assert.Equal(t, http.StatusAccepted, code)
+}
+
+func TestGogsSecret(t *testing.T) {
+	body := `{"ref": "refs/heads/main"}`
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	for i, test := range []struct {
+		secret    string
+		signature string
+		code      int
+	}{
+		{"", "", http.StatusOK},
+		{"secret", signature, http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "0123", http.StatusForbidden},
+		{"", signature, http.StatusForbidden},
+	} {
+		hc := &HookConf{
+			Secret:  test.secret,
+			RefName: plumbing.ReferenceName("refs/heads/main"),
+		}
+
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		req.Header.Add("X-Gogs-Event", "push")
+		if test.signature != "" {
+			req.Header.Add("X-Gogs-Signature", test.signature)
+		}
+
+		_, code, _ := handle(Gogs{}, req, hc)
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+	}
+}
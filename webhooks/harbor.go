@@ -0,0 +1,131 @@
+package webhooks
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Harbor handles webhooks of Harbor projects. The secret is the auth
+// header of the webhook policy, which Harbor sends as the
+// Authorization header.
+type Harbor struct {
+}
+
+type harborEvent struct {
+	Type      string `json:"type"`
+	EventData struct {
+		Resources []struct {
+			Digest      string `json:"digest"`
+			Tag         string `json:"tag"`
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+		Repository struct {
+			RepoFullName string `json:"repo_full_name"`
+		} `json:"repository"`
+	} `json:"event_data"`
+}
+
+func (h Harbor) Handle(r *http.Request, body []byte, hc *HookConf) (*Event, int, error) {
+	err := checkRepository(hc, body, parseHarborRepository)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+
+	err = h.handleAuth(r, hc.Secret)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+
+	var payload harborEvent
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+
+	event := payload.Type
+	if event == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("field 'type' missing")
+	}
+
+	if !hc.HandlesEvent(event) {
+		return nil, http.StatusAccepted, fmt.Errorf("event: %s, not in events", event)
+	}
+
+	switch event {
+	case "PUSH_ARTIFACT":
+		image, err := h.handlePush(&payload)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, Image: image}, http.StatusOK, nil
+	default:
+		return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q event", event)
+	}
+}
+
+// handleAuth verifies the Authorization header, which is required if
+// the secret is set.
+func (h Harbor) handleAuth(r *http.Request, secret string) error {
+	if secret == "" {
+		return nil
+	}
+
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return unauthorized("header 'Authorization' missing")
+	}
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(secret)) != 1 {
+		return forbidden("invalid authorization")
+	}
+	return nil
+}
+
+func (h Harbor) handlePush(payload *harborEvent) (*Image, error) {
+	resources := payload.EventData.Resources
+	if len(resources) == 0 {
+		return nil, fmt.Errorf("the push was incomplete, missing resources")
+	}
+
+	resource := resources[0]
+	if resource.Tag == "" {
+		return nil, ignore("event: push of untagged artifact %s", resource.Digest)
+	}
+
+	name := harborImageName(resource.ResourceURL)
+	if name == "" {
+		name = payload.EventData.Repository.RepoFullName
+	}
+	return &Image{Name: name, Tag: resource.Tag, Digest: resource.Digest}, nil
+}
+
+// harborImageName returns the image name of the resource URL, such as
+// harbor.example.com/library/nginx of
+// harbor.example.com/library/nginx:latest.
+func harborImageName(resourceURL string) string {
+	name := resourceURL
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return name
+}
+
+func parseHarborRepository(body []byte) (*Repository, error) {
+	var payload harborEvent
+
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Repository{FullName: payload.EventData.Repository.RepoFullName}
+	for _, resource := range payload.EventData.Resources {
+		r.URLs = append(r.URLs, harborImageName(resource.ResourceURL))
+	}
+	return r, nil
+}
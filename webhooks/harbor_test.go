@@ -0,0 +1,91 @@
+package webhooks
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/alecthomas/assert"
+)
+
+func TestHarborHandle(t *testing.T) {
+	harborHook := Harbor{}
+
+	for i, test := range []struct {
+		auth       string
+		secret     string
+		repository string
+		body       string
+		code       int
+	}{
+		{"", "", "", pushHarborBodyValid, http.StatusOK},
+		{"Bearer secret", "Bearer secret", "", pushHarborBodyValid, http.StatusOK},
+		{"", "Bearer secret", "", pushHarborBodyValid, http.StatusUnauthorized},
+		{"Bearer wrong", "Bearer secret", "", pushHarborBodyValid, http.StatusForbidden},
+		{"", "", "library/nginx", pushHarborBodyValid, http.StatusOK},
+		{"", "", "harbor.example.com/library/nginx", pushHarborBodyValid, http.StatusOK},
+		{"", "", "library/redis", pushHarborBodyValid, http.StatusBadRequest},
+		{"", "", "", `{"type": "DELETE_ARTIFACT"}`, http.StatusAccepted},
+		{"", "", "", `{"type": "PUSH_ARTIFACT", "event_data": {"resources": [{"digest": "sha256:abc"}]}}`, http.StatusAccepted},
+		{"", "", "", `{}`, http.StatusBadRequest},
+	} {
+		hc := &HookConf{
+			Secret:     test.secret,
+			Repository: test.repository,
+		}
+
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(test.body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+		if test.auth != "" {
+			req.Header.Add("Authorization", test.auth)
+		}
+
+		event, code, _ := handle(harborHook, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+		if code == http.StatusOK {
+			assert.Equal(t, "harbor.example.com/library/nginx", event.Image.Name, fmt.Sprintf("case %d", i))
+			assert.Equal(t, "1.19", event.Image.Tag, fmt.Sprintf("case %d", i))
+			assert.Equal(t, "sha256:1a2b3c4d", event.Image.Digest, fmt.Sprintf("case %d", i))
+		}
+	}
+}
+
+func TestHarborImageName(t *testing.T) {
+	for i, test := range []struct {
+		url  string
+		name string
+	}{
+		{"harbor.example.com/library/nginx:latest", "harbor.example.com/library/nginx"},
+		{"harbor.example.com:8443/library/nginx:latest", "harbor.example.com:8443/library/nginx"},
+		{"harbor.example.com:8443/library/nginx@sha256:1a2b3c4d", "harbor.example.com:8443/library/nginx"},
+		{"harbor.example.com/library/nginx", "harbor.example.com/library/nginx"},
+	} {
+		assert.Equal(t, test.name, harborImageName(test.url), fmt.Sprintf("case %d", i))
+	}
+}
+
+var pushHarborBodyValid = `
+{
+	"type": "PUSH_ARTIFACT",
+	"occur_at": 1617273600,
+	"operator": "admin",
+	"event_data": {
+		"resources": [
+			{
+				"digest": "sha256:1a2b3c4d",
+				"tag": "1.19",
+				"resource_url": "harbor.example.com/library/nginx:1.19"
+			}
+		],
+		"repository": {
+			"date_created": 1617273000,
+			"name": "nginx",
+			"namespace": "library",
+			"repo_full_name": "library/nginx",
+			"repo_type": "public"
+		}
+	}
+}
+`
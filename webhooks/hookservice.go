@@ -1,17 +1,221 @@
 package webhooks
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
 
 	"github.com/go-git/go-git/v5/plumbing"
 )
 
+const (
+	// TriggerPush updates the repository on push events.
+	TriggerPush = "push"
+
+	// TriggerCI updates the repository once CI passed on the
+	// pushed commit.
+	TriggerCI = "ci"
+)
+
 type HookConf struct {
 	Secret string
 
+	// Repository is the full name or URL of the repository events
+	// must be for. Events for other repositories are rejected with
+	// ErrRepositoryMismatch. Empty accepts any repository.
+	Repository string
+
 	RefName plumbing.ReferenceName
+
+	// Trigger tells which events update the repository, either
+	// TriggerPush or TriggerCI.
+	Trigger string
+
+	// Workflow is the name or path of the GitHub Actions workflow
+	// whose successful runs are deployed with TriggerCI.
+	Workflow string
+
+	// Token authenticates requests to the API of the service, such
+	// as for the combined status of a commit.
+	Token string
+
+	// SkipIfMessage skips a push if the message of its head commit
+	// contains any of them.
+	SkipIfMessage []string
+
+	// Paths skips a push unless it changes any path matching them.
+	Paths []string
+
+	// PathsIgnore skips a push if it only changes paths matching them.
+	PathsIgnore []string
+
+	// Previews enables handling pull (merge) request events.
+	Previews bool
+
+	// PreviewForks enables previews of pull requests from forks,
+	// whose code is run by the command.
+	PreviewForks bool
+
+	// Events are the names of the events to handle, among those
+	// the service handles. Empty handles all of them.
+	Events []string
+}
+
+// HandlesEvent reports whether the event is among the events to handle.
+func (hc *HookConf) HandlesEvent(name string) bool {
+	if len(hc.Events) == 0 {
+		return true
+	}
+	for _, event := range hc.Events {
+		if event == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Event tells what a webhook request asks for.
+type Event struct {
+	// Name of the event given by the webhook service.
+	Name string
+
+	// Ref the event is for, such as refs/heads/main. Events are
+	// only accepted for the tracked ref.
+	Ref string
+
+	// Commit to check out, such as the one checked by CI. Empty
+	// means the latest commit of the tracked branch.
+	Commit string
+
+	// Head is the commit the ref was pushed to, which is told to the
+	// command. The repository is still updated to the latest commit.
+	Head string
+
+	// PullRequest is set when the event is about a pull request
+	// to preview.
+	PullRequest *PullRequest
+
+	// Image is set when the event is about a container image pushed
+	// to a registry.
+	Image *Image
+
+	// Ping is set for the events sent to test or set up the
+	// webhook, such as SNS subscription confirmations, which are not
+	// deployed.
+	Ping bool
+}
+
+// Image tells information about a container image pushed to a registry.
+type Image struct {
+	// Name of the image to pull, such as winglim/caddy or
+	// ghcr.io/winglim/caddy.
+	Name string
+
+	Tag string
+
+	// Digest of the image, such as sha256:<hex>, if known.
+	Digest string
 }
 
+// PullRequest tells information about a pull (merge) request.
+type PullRequest struct {
+	Number int
+
+	// Ref holds the head of the pull request in the base repository,
+	// such as refs/pull/1/head.
+	Ref plumbing.ReferenceName
+
+	// Closed reports whether the pull request was closed or merged.
+	Closed bool
+}
+
+// checkFork ignores the open pull request if it is from a fork, unless
+// previews of forks are enabled.
+func checkFork(pr *PullRequest, fork bool, hc *HookConf) error {
+	if fork && !pr.Closed && !hc.PreviewForks {
+		return ignore("event: pull request %d from a fork", pr.Number)
+	}
+	return nil
+}
+
+// HookService handles the webhook requests of a service. The body of
+// the request is read by the caller.
 type HookService interface {
-	Handle(*http.Request, *HookConf) (int, error)
+	Handle(r *http.Request, body []byte, hc *HookConf) (*Event, int, error)
+}
+
+// StatusError is an error with the status code to respond with.
+type StatusError struct {
+	Code int
+	Err  error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// ignore returns the error telling why a valid event is not deployed,
+// which is answered with 202 Accepted.
+func ignore(format string, a ...interface{}) error {
+	return &StatusError{Code: http.StatusAccepted, Err: fmt.Errorf(format, a...)}
+}
+
+// unauthorized returns the error of a request missing the signature or
+// token to verify it, which is answered with 401 Unauthorized.
+func unauthorized(format string, a ...interface{}) error {
+	return &StatusError{Code: http.StatusUnauthorized, Err: fmt.Errorf(format, a...)}
+}
+
+// forbidden returns the error of a request whose signature or token is
+// invalid, which is answered with 403 Forbidden.
+func forbidden(format string, a ...interface{}) error {
+	return &StatusError{Code: http.StatusForbidden, Err: fmt.Errorf(format, a...)}
+}
+
+// statusCode returns the status code to respond to err with, which is
+// 400 Bad Request for malformed requests.
+func statusCode(err error) int {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code
+	}
+	return http.StatusBadRequest
+}
+
+// maxNonces is the number of recent nonces a nonceCache remembers.
+const maxNonces = 1024
+
+// nonceCache remembers the nonces of recent requests, so that replayed
+// requests are rejected.
+type nonceCache struct {
+	mu    sync.Mutex
+	seen  map[string]bool
+	order []string
+	next  int
+}
+
+// add records the nonce, and reports whether it was not seen yet. The
+// oldest nonce is forgotten once maxNonces are remembered.
+func (c *nonceCache) add(nonce string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.seen[nonce] {
+		return false
+	}
+	if c.seen == nil {
+		c.seen = make(map[string]bool)
+		c.order = make([]string, maxNonces)
+	}
+
+	delete(c.seen, c.order[c.next])
+	c.order[c.next] = nonce
+	c.next = (c.next + 1) % maxNonces
+	c.seen[nonce] = true
+	return true
 }
@@ -0,0 +1,51 @@
+package webhooks
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/alecthomas/assert"
+)
+
+// handle handles the request with the hook service, as the handler
+// does after reading the body.
+func handle(h HookService, r *http.Request, hc *HookConf) (*Event, int, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return h.Handle(r, body, hc)
+}
+
+func TestStatusCode(t *testing.T) {
+	for i, test := range []struct {
+		err  error
+		code int
+	}{
+		{errors.New("invalid"), http.StatusBadRequest},
+		{ignore("event: %s", "star"), http.StatusAccepted},
+		{unauthorized("header missing"), http.StatusUnauthorized},
+		{forbidden("invalid signature"), http.StatusForbidden},
+		{fmt.Errorf("wrapped: %w", forbidden("invalid signature")), http.StatusForbidden},
+	} {
+		assert.Equal(t, test.code, statusCode(test.err), fmt.Sprintf("case %d", i))
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	var c nonceCache
+	assert.True(t, c.add("first"))
+	assert.False(t, c.add("first"))
+
+	// The oldest nonce is forgotten once the cache is full.
+	for i := 1; i < maxNonces; i++ {
+		assert.True(t, c.add(fmt.Sprintf("nonce %d", i)))
+	}
+	assert.False(t, c.add("first"))
+	assert.True(t, c.add("last"))
+	assert.True(t, c.add("first"))
+	assert.False(t, c.add("last"))
+}
@@ -0,0 +1,132 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ErrRepositoryMismatch is returned when the event is for another
+// repository than HookConf.Repository.
+var ErrRepositoryMismatch = errors.New("repository mismatch")
+
+// Repository tells the identity of the repository an event is for.
+type Repository struct {
+	// FullName is the path of the repository on the git service,
+	// such as WingLim/caddy-webhook.
+	FullName string
+
+	// URLs of the repository, such as the clone, ssh and web URLs.
+	URLs []string
+}
+
+// hubRepository is the repository in payloads of GitHub, Gitee, Gogs
+// and Gitea.
+type hubRepository struct {
+	Repository struct {
+		FullName string `json:"full_name"`
+		CloneURL string `json:"clone_url"`
+		SSHURL   string `json:"ssh_url"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+}
+
+// parseHubRepository parses the repository of GitHub, Gitee, Gogs and
+// Gitea payloads.
+func parseHubRepository(body []byte) (*Repository, error) {
+	var payload hubRepository
+
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := payload.Repository
+	return &Repository{
+		FullName: repo.FullName,
+		URLs:     []string{repo.CloneURL, repo.SSHURL, repo.HTMLURL},
+	}, nil
+}
+
+// checkRepository checks the repository parsed from the body is
+// HookConf.Repository, if set.
+func checkRepository(hc *HookConf, body []byte, parse func([]byte) (*Repository, error)) error {
+	if hc.Repository == "" {
+		return nil
+	}
+
+	repo, err := parse(body)
+	if err != nil {
+		return err
+	}
+
+	if !repo.Matches(hc.Repository) {
+		name := repo.FullName
+		if name == "" {
+			name = "unknown repository"
+		}
+		return fmt.Errorf("%w: event for %s, not %s", ErrRepositoryMismatch, name, normalizeRepositoryURL(hc.Repository))
+	}
+	return nil
+}
+
+// Matches reports whether the repository is identified by id, which is
+// either a full name or an URL of the repository.
+func (repo *Repository) Matches(id string) bool {
+	normalized := normalizeRepositoryURL(id)
+
+	// The full name is the path of the URL.
+	name := normalized
+	if isRepositoryURL(id) {
+		if i := strings.Index(normalized, "/"); i >= 0 {
+			name = normalized[i+1:]
+		}
+	}
+	if repo.FullName != "" && strings.EqualFold(name, repo.FullName) {
+		return true
+	}
+
+	for _, u := range repo.URLs {
+		if u != "" && strings.EqualFold(normalizeRepositoryURL(u), normalized) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRepositoryURL reports whether id is an URL rather than a full name.
+func isRepositoryURL(id string) bool {
+	if strings.Contains(id, "://") {
+		return true
+	}
+
+	// scp-like syntax: git@github.com:WingLim/caddy-webhook.git
+	colon := strings.Index(id, ":")
+	return colon > 0 && !strings.Contains(id[:colon], "/")
+}
+
+// normalizeRepositoryURL reduces the URL of a repository to its host
+// and path, such as github.com/WingLim/caddy-webhook, so the http and
+// ssh URLs of a repository are equal. Full names are returned as is,
+// without the `.git` suffix.
+func normalizeRepositoryURL(id string) string {
+	id = strings.TrimSpace(id)
+
+	if strings.Contains(id, "://") {
+		if u, err := url.Parse(id); err == nil {
+			id = u.Hostname() + u.Path
+		}
+	} else if isRepositoryURL(id) {
+		colon := strings.Index(id, ":")
+		host := id[:colon]
+		if at := strings.LastIndex(host, "@"); at >= 0 {
+			host = host[at+1:]
+		}
+		id = host + "/" + strings.TrimPrefix(id[colon+1:], "/")
+	}
+
+	id = strings.TrimSuffix(id, "/")
+	return strings.TrimSuffix(id, ".git")
+}
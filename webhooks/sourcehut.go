@@ -0,0 +1,156 @@
+package webhooks
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Sourcehut handles webhooks of git.sr.ht. The secret is the base64
+// encoded ed25519 public key of the sr.ht instance, which signs the
+// payload and nonce of every webhook. Requests are accepted once per
+// nonce.
+type Sourcehut struct {
+	nonces nonceCache
+}
+
+type srhtPostUpdate struct {
+	Refs []struct {
+		Name string `json:"name"`
+		New  *struct {
+			ID string `json:"id"`
+		} `json:"new"`
+	} `json:"refs"`
+}
+
+type srhtRepository struct {
+	Repository *struct {
+		Name  string `json:"name"`
+		Owner struct {
+			CanonicalName string `json:"canonical_name"`
+		} `json:"owner"`
+	} `json:"repository"`
+}
+
+func (s *Sourcehut) Handle(r *http.Request, body []byte, hc *HookConf) (*Event, int, error) {
+	// The repository is only checked if the payload tells it.
+	repo, err := parseSourcehutRepository(body)
+	if err == nil && repo.FullName != "" {
+		err := checkRepository(hc, body, parseSourcehutRepository)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+	}
+
+	err = s.handleSignature(r, body, hc.Secret)
+	if err != nil {
+		return nil, statusCode(err), err
+	}
+
+	event := r.Header.Get("X-Webhook-Event")
+	if event == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("header 'X-Webhook-Event' missing")
+	}
+
+	if !hc.HandlesEvent(event) {
+		return nil, http.StatusAccepted, fmt.Errorf("event: %s, not in events", event)
+	}
+
+	switch event {
+	case "repo:post-update":
+		commit, err := s.handlePostUpdate(body, hc)
+		if err != nil {
+			return nil, statusCode(err), err
+		}
+		return &Event{Name: event, Ref: hc.RefName.String(), Head: commit}, http.StatusOK, nil
+	default:
+		return nil, http.StatusAccepted, fmt.Errorf("cannot handle %q event", event)
+	}
+}
+
+// handleSignature verifies the X-Payload-Signature header, the ed25519
+// signature of the body followed by the X-Payload-Nonce header.
+func (s *Sourcehut) handleSignature(r *http.Request, body []byte, secret string) error {
+	if secret == "" {
+		return forbidden("empty webhook public key")
+	}
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return forbidden("invalid webhook public key")
+	}
+
+	header := r.Header.Get("X-Payload-Signature")
+	if header == "" {
+		return unauthorized("header 'X-Payload-Signature' missing")
+	}
+	signature, err := base64.StdEncoding.DecodeString(header)
+	if err != nil || len(signature) == 0 {
+		return forbidden("invalid signature")
+	}
+
+	nonce := r.Header.Get("X-Payload-Nonce")
+	if nonce == "" {
+		return unauthorized("header 'X-Payload-Nonce' missing")
+	}
+
+	signed := append(append([]byte{}, body...), nonce...)
+	if !ed25519.Verify(ed25519.PublicKey(key), signed, signature) {
+		return forbidden("invalid signature")
+	}
+
+	if !s.nonces.add(nonce) {
+		return forbidden("replayed nonce %s", nonce)
+	}
+	return nil
+}
+
+// handlePostUpdate returns the commit the tracked ref was pushed to.
+func (s *Sourcehut) handlePostUpdate(body []byte, hc *HookConf) (string, error) {
+	var update srhtPostUpdate
+
+	err := json.Unmarshal(body, &update)
+	if err != nil {
+		return "", err
+	}
+
+	if len(update.Refs) == 0 {
+		return "", fmt.Errorf("the push was incomplete, missing refs")
+	}
+
+	for _, ref := range update.Refs {
+		refName := plumbing.ReferenceName(ref.Name)
+		if refName == hc.RefName {
+			if ref.New == nil {
+				return "", ignore("event: delete %s", refName)
+			}
+			if ref.New.ID == "" {
+				return "", fmt.Errorf("invalid (empty) commit id")
+			}
+			return ref.New.ID, nil
+		}
+	}
+
+	return "", ignore("event: push to %s", update.Refs[0].Name)
+}
+
+// parseSourcehutRepository parses the repository of the payload, whose
+// full name is the canonical name of the owner and the repository name,
+// such as ~sircmpwn/git.sr.ht.
+func parseSourcehutRepository(body []byte) (*Repository, error) {
+	var payload srhtRepository
+
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Repository{}
+	if repo := payload.Repository; repo != nil && repo.Name != "" && repo.Owner.CanonicalName != "" {
+		r.FullName = repo.Owner.CanonicalName + "/" + repo.Name
+	}
+	return r, nil
+}
@@ -0,0 +1,179 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestSourcehutHandle(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	hc := &HookConf{
+		Secret:     base64.StdEncoding.EncodeToString(public),
+		Repository: "https://git.sr.ht/~winglim/blog",
+		RefName:    plumbing.ReferenceName("refs/heads/main"),
+	}
+	srhtHook := &Sourcehut{}
+
+	for i, test := range []struct {
+		body   string
+		event  string
+		key    ed25519.PrivateKey
+		code   int
+		commit string
+	}{
+		{postUpdateSRHTBodyValid, "repo:post-update", private, http.StatusOK, "e7a3ba2d7f8c8a9d0b1c2d3e4f5a6b7c8d9e0f1a"},
+		{postUpdateSRHTBodyValid, "repo:post-update", other, http.StatusForbidden, ""},
+		{postUpdateSRHTBodyValid, "", private, http.StatusBadRequest, ""},
+		{postUpdateSRHTBodyValid, "ticket:create", private, http.StatusAccepted, ""},
+		{postUpdateSRHTBodyOtherRepo, "repo:post-update", private, http.StatusBadRequest, ""},
+		{postUpdateSRHTBodyDelete, "repo:post-update", private, http.StatusAccepted, ""},
+		{postUpdateSRHTBodyTag, "repo:post-update", private, http.StatusAccepted, ""},
+		{`{"refs": []}`, "repo:post-update", private, http.StatusBadRequest, ""},
+	} {
+		req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(test.body)))
+		assert.Nil(t, err, fmt.Sprintf("case %d", i))
+
+		nonce := fmt.Sprintf("nonce-%d", i)
+		signature := ed25519.Sign(test.key, append([]byte(test.body), nonce...))
+		req.Header.Add("X-Payload-Signature", base64.StdEncoding.EncodeToString(signature))
+		req.Header.Add("X-Payload-Nonce", nonce)
+		if test.event != "" {
+			req.Header.Add("X-Webhook-Event", test.event)
+		}
+
+		event, code, _ := handle(srhtHook, req, hc)
+
+		assert.Equal(t, test.code, code, fmt.Sprintf("case %d", i))
+		if code == http.StatusOK {
+			assert.Equal(t, test.commit, event.Head, fmt.Sprintf("case %d", i))
+		}
+	}
+
+	// The nonce is signed as well.
+	body := postUpdateSRHTBodyValid
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(body)))
+	assert.Nil(t, err)
+	signature := ed25519.Sign(private, append([]byte(body), "1234567890"...))
+	req.Header.Add("X-Payload-Signature", base64.StdEncoding.EncodeToString(signature))
+	req.Header.Add("X-Payload-Nonce", "0987654321")
+	req.Header.Add("X-Webhook-Event", "repo:post-update")
+	_, code, _ := handle(srhtHook, req, hc)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// The tracked tag is deployed at the commit it was pushed to.
+	tag := &HookConf{
+		Secret:     hc.Secret,
+		Repository: hc.Repository,
+		RefName:    plumbing.ReferenceName("refs/tags/v1.0.0"),
+	}
+	body = postUpdateSRHTBodyTag
+	req, err = http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(body)))
+	assert.Nil(t, err)
+	signature = ed25519.Sign(private, append([]byte(body), "tag"...))
+	req.Header.Add("X-Payload-Signature", base64.StdEncoding.EncodeToString(signature))
+	req.Header.Add("X-Payload-Nonce", "tag")
+	req.Header.Add("X-Webhook-Event", "repo:post-update")
+	event, code, _ := handle(srhtHook, req, tag)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "e7a3ba2d7f8c8a9d0b1c2d3e4f5a6b7c8d9e0f1a", event.Head)
+
+	// Replayed requests are rejected.
+	req, err = http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(body)))
+	assert.Nil(t, err)
+	req.Header.Add("X-Payload-Signature", base64.StdEncoding.EncodeToString(signature))
+	req.Header.Add("X-Payload-Nonce", "tag")
+	req.Header.Add("X-Webhook-Event", "repo:post-update")
+	_, code, _ = handle(srhtHook, req, tag)
+	assert.Equal(t, http.StatusForbidden, code)
+}
+
+var postUpdateSRHTBodyValid = `
+{
+	"push": "b2bd3b6d-0a6b-4a4b-9b4f-6b1c1b6d7f3e",
+	"pusher": {
+		"canonical_name": "~winglim",
+		"name": "winglim"
+	},
+	"repository": {
+		"name": "blog",
+		"owner": {
+			"canonical_name": "~winglim",
+			"name": "winglim"
+		}
+	},
+	"refs": [
+		{
+			"annotated_tag": null,
+			"name": "refs/heads/main",
+			"old": {
+				"id": "1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b"
+			},
+			"new": {
+				"id": "e7a3ba2d7f8c8a9d0b1c2d3e4f5a6b7c8d9e0f1a",
+				"message": "Update about page\n"
+			}
+		}
+	]
+}
+`
+
+var postUpdateSRHTBodyOtherRepo = `
+{
+	"repository": {
+		"name": "docs",
+		"owner": {
+			"canonical_name": "~winglim"
+		}
+	},
+	"refs": [
+		{
+			"name": "refs/heads/main",
+			"new": {
+				"id": "e7a3ba2d7f8c8a9d0b1c2d3e4f5a6b7c8d9e0f1a"
+			}
+		}
+	]
+}
+`
+
+var postUpdateSRHTBodyDelete = `
+{
+	"refs": [
+		{
+			"name": "refs/heads/main",
+			"old": {
+				"id": "e7a3ba2d7f8c8a9d0b1c2d3e4f5a6b7c8d9e0f1a"
+			},
+			"new": null
+		}
+	]
+}
+`
+
+var postUpdateSRHTBodyTag = `
+{
+	"refs": [
+		{
+			"annotated_tag": {
+				"name": "v1.0.0"
+			},
+			"name": "refs/tags/v1.0.0",
+			"new": {
+				"id": "e7a3ba2d7f8c8a9d0b1c2d3e4f5a6b7c8d9e0f1a"
+			}
+		}
+	]
+}
+`